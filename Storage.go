@@ -19,8 +19,9 @@ type Action struct {
 }
 
 type Storage struct {
-	lock    *sync.Mutex
-	mapping map[string]*Action
+	lock        *sync.Mutex
+	mapping     map[string]*Action
+	certificate *util.Certificate
 }
 
 func NewStorage() *Storage {
@@ -30,6 +31,13 @@ func NewStorage() *Storage {
 	}
 }
 
+// NewStorageWithCertificate 使用指定根证书签发子证书，为 nil 时使用全局 util.Cert
+func NewStorageWithCertificate(certificate *util.Certificate) *Storage {
+	storage := NewStorage()
+	storage.certificate = certificate
+	return storage
+}
+
 func (i *Storage) do(action *Action, host string, callback func() (interface{}, error)) {
 	defer func() {
 		action.wg.Done()
@@ -55,7 +63,7 @@ func (i *Storage) GetCertificate(hostname string, port string) (interface{}, err
 	// 对不同的域名的并发,同一时刻只生成一个域名处理对象
 	i.mapping[host] = &Action{
 		wg: &sync.WaitGroup{},
-		fn: GetAction(host),
+		fn: i.action(host),
 	}
 	i.mapping[host].wg.Add(1)
 	i.lock.Unlock()
@@ -63,10 +71,23 @@ func (i *Storage) GetCertificate(hostname string, port string) (interface{}, err
 	return i.mapping[host].cert, i.mapping[host].err
 }
 
+func (i *Storage) action(hostname string) func() (interface{}, error) {
+	if i.certificate == nil {
+		return GetAction(hostname)
+	}
+	return GetActionWithCertificate(i.certificate, hostname)
+}
+
 func GetAction(hostname string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		return GetActionWithCertificate(util.Cert, hostname)()
+	}
+}
+
+func GetActionWithCertificate(certificate *util.Certificate, hostname string) func() (interface{}, error) {
 	return func() (interface{}, error) {
 		// 为每个host:port生成单独的证书
-		cert, privateKey, err := util.Cert.GeneratePem(hostname)
+		cert, privateKey, err := certificate.GeneratePem(hostname)
 		if err != nil {
 			return nil, err
 		}
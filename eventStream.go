@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+func mediaType(header http.Header) string {
+	media, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return strings.ToLower(media)
+}
+
+// isEventStream Server-Sent Events 响应
+func isEventStream(header http.Header) bool {
+	return mediaType(header) == "text/event-stream"
+}
+
+// isNDJSON 换行分隔的 JSON 流
+func isNDJSON(header http.Header) bool {
+	media := mediaType(header)
+	return media == "application/x-ndjson" || media == "application/ndjson"
+}
+
+// eventReader 逐个解析 SSE 事件并交给钩子，Read 每次最多返回一个事件，保证事件及时写出
+type eventReader struct {
+	id        string
+	reader    *bufio.Reader
+	body      io.Closer
+	eventCall model.EventCall
+	pending   []byte
+	err       error
+}
+
+func newEventReader(id string, body io.ReadCloser, eventCall model.EventCall) io.ReadCloser {
+	return &eventReader{
+		id:        id,
+		reader:    bufio.NewReader(body),
+		body:      body,
+		eventCall: eventCall,
+	}
+}
+
+func (r *eventReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.pending, r.err = r.nextEvent()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *eventReader) Close() error {
+	return r.body.Close()
+}
+
+// nextEvent 读取到空行为止的一个事件块，返回需要写给客户端的字节
+func (r *eventReader) nextEvent() ([]byte, error) {
+	var raw bytes.Buffer
+	var lines []string
+	for {
+		line, err := r.reader.ReadString('\n')
+		raw.WriteString(line)
+		trimmed := strings.TrimRight(line, "\r\n")
+		if err != nil {
+			// 上游结束时残留的不完整事件原样转发
+			return raw.Bytes(), err
+		}
+		if trimmed == "" {
+			break
+		}
+		lines = append(lines, trimmed)
+	}
+
+	event, ok := parseEvent(lines)
+	if !ok {
+		// 只有注释（心跳）的块不交给钩子
+		return raw.Bytes(), nil
+	}
+	event.ID = r.id
+	result := r.eventCall(event)
+	if result.Drop {
+		return nil, nil
+	}
+	result.ID = event.ID
+	result.Event = hookValue(result.Event, event.Event, result.Modified)
+	result.Data = hookValue(result.Data, event.Data, result.Modified)
+	result.EventID = hookValue(result.EventID, event.EventID, result.Modified)
+	result.Retry = hookValue(result.Retry, event.Retry, result.Modified)
+	result.Modified = false // 只比较内容
+	if result == event {
+		return raw.Bytes(), nil
+	}
+	return formatEvent(result), nil
+}
+
+// parseEvent 按 SSE 规范解析字段，没有任何字段时返回 false
+func parseEvent(lines []string) (model.EventData, bool) {
+	var event model.EventData
+	var data []string
+	found := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			event.EventID = value
+		case "retry":
+			event.Retry = value
+		default:
+			continue
+		}
+		found = true
+	}
+	event.Data = strings.Join(data, "\n")
+	return event, found
+}
+
+func formatEvent(event model.EventData) []byte {
+	var buf bytes.Buffer
+	if event.EventID != "" {
+		buf.WriteString("id: " + event.EventID + "\n")
+	}
+	if event.Event != "" {
+		buf.WriteString("event: " + event.Event + "\n")
+	}
+	if event.Retry != "" {
+		buf.WriteString("retry: " + event.Retry + "\n")
+	}
+	for _, line := range strings.Split(event.Data, "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
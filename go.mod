@@ -1,8 +1,12 @@
 module github.com/xyjwsj/request-proxy
 
-go 1.24
+go 1.24.0
 
 require (
 	github.com/google/brotli/go/cbrotli v1.1.0
 	github.com/google/uuid v1.6.0
+	golang.org/x/net v0.50.0
+	google.golang.org/protobuf v1.36.9
 )
+
+require golang.org/x/text v0.34.0 // indirect
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// maxGrpcMessage 单条 gRPC 消息的最大长度
+const maxGrpcMessage = 64 << 20
+
+var errGrpcTooLarge = errors.New("proxy: grpc message too large")
+
+// ConfigGrpc 配置 gRPC 消息钩子。descriptorSet 为序列化的 FileDescriptorSet（protoc --descriptor_set_out），
+// 不为空时按方法的输入输出类型把消息解码为 JSON 交给钩子；为 nil 时钩子只能看到原始 protobuf
+func (s *Server) ConfigGrpc(descriptorSet []byte, onMessage model.GrpcCall) error {
+	var files *protoregistry.Files
+	if len(descriptorSet) > 0 {
+		set := &descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(descriptorSet, set); err != nil {
+			return err
+		}
+		var err error
+		if files, err = protodesc.NewFiles(set); err != nil {
+			return err
+		}
+	}
+	s.config.grpcFiles = files
+	s.config.grpcCall = onMessage
+	return nil
+}
+
+// isGrpc 判断是否为 gRPC 请求：application/grpc 或 application/grpc+<codec>。
+// gRPC-Web 的帧格式和传输方式不同，不按 gRPC 处理
+func isGrpc(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// serveGrpcStream 流式转发 gRPC 调用：请求和响应按消息拆分后交给钩子，trailer（grpc-status）原样写回
+func (s *Server) serveGrpcStream(wrapReq model.WrapRequest, w http.ResponseWriter, request *http.Request) {
+	milli := time.Now().UnixMilli()
+	interceptorRequest(wrapReq, request, nil)
+
+	if s.config.grpcCall != nil {
+		call := s.newGrpcCall(wrapReq.ID, request.URL.Path, request.Header.Get("Grpc-Encoding"))
+		request.Body = &grpcReader{src: request.Body, transform: call.transform(true)}
+		request.ContentLength = -1
+		request.Header.Del("Content-Length")
+	}
+	response, err := s.transport(request)
+	if err != nil {
+		log.Println(err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+	wrapReq.Duration = time.Now().UnixMilli() - milli
+
+	if s.config.grpcCall != nil {
+		call := s.newGrpcCall(wrapReq.ID, request.URL.Path, response.Header.Get("Grpc-Encoding"))
+		response.Body = &grpcReader{src: response.Body, transform: call.transform(false)}
+		response.Header.Del("Content-Length")
+	}
+	s.writeHTTP2Stream(wrapReq, w, response)
+}
+
+// grpcCall 一次 gRPC 调用中一个方向的消息处理
+type grpcCall struct {
+	id       string
+	method   string
+	encoding string
+	onEvent  model.GrpcCall
+	input    protoreflect.MessageDescriptor
+	output   protoreflect.MessageDescriptor
+}
+
+func (s *Server) newGrpcCall(id, method, encoding string) *grpcCall {
+	call := &grpcCall{id: id, method: method, encoding: encoding, onEvent: s.config.grpcCall}
+	if s.config.grpcFiles == nil {
+		return call
+	}
+	// 方法路径为 /package.Service/Method
+	service, name, ok := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	if !ok {
+		return call
+	}
+	desc, err := s.config.grpcFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return call
+	}
+	if sd, ok := desc.(protoreflect.ServiceDescriptor); ok {
+		if md := sd.Methods().ByName(protoreflect.Name(name)); md != nil {
+			call.input, call.output = md.Input(), md.Output()
+		}
+	}
+	return call
+}
+
+// transform 返回处理单条消息的函数：解压、解码、调用钩子、重新编码
+func (c *grpcCall) transform(upstream bool) func(compressed bool, payload []byte) (bool, []byte, bool, error) {
+	descriptor := c.output
+	if upstream {
+		descriptor = c.input
+	}
+	return func(compressed bool, payload []byte) (bool, []byte, bool, error) {
+		if compressed && c.encoding != "gzip" {
+			// 未知压缩算法，原样转发
+			return compressed, payload, false, nil
+		}
+		var err error
+		if compressed {
+			if payload, err = gunzip(payload); err != nil {
+				return false, nil, false, err
+			}
+		}
+		data := model.GrpcMessage{ID: c.id, Method: c.method, Upstream: upstream, Payload: payload}
+		if descriptor != nil {
+			if data.Json, err = decodeGrpcJson(descriptor, payload); err != nil {
+				log.Println("gRPC 消息解码失败：" + err.Error())
+			}
+		}
+
+		result := c.onEvent(data)
+		if result.Drop {
+			return false, nil, true, nil
+		}
+		out := hookValue(result.Payload, payload, result.Modified)
+		if descriptor != nil && result.Json != "" && result.Json != data.Json {
+			if out, err = encodeGrpcJson(descriptor, result.Json); err != nil {
+				return false, nil, false, err
+			}
+		}
+		if compressed {
+			if out, err = encodeBody("gzip", out); err != nil {
+				return false, nil, false, err
+			}
+		}
+		return compressed, out, false, nil
+	}
+}
+
+func decodeGrpcJson(descriptor protoreflect.MessageDescriptor, payload []byte) (string, error) {
+	message := dynamicpb.NewMessage(descriptor)
+	if err := proto.Unmarshal(payload, message); err != nil {
+		return "", err
+	}
+	data, err := protojson.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func encodeGrpcJson(descriptor protoreflect.MessageDescriptor, value string) ([]byte, error) {
+	message := dynamicpb.NewMessage(descriptor)
+	if err := protojson.Unmarshal([]byte(value), message); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(message)
+}
+
+func gunzip(payload []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(io.LimitReader(reader, maxGrpcMessage))
+}
+
+// grpcReader 按 gRPC 长度前缀帧（1 字节压缩标志 + 4 字节长度）读取消息，处理后重新组帧
+type grpcReader struct {
+	src       io.ReadCloser
+	pending   bytes.Buffer
+	transform func(compressed bool, payload []byte) (bool, []byte, bool, error)
+}
+
+func (r *grpcReader) Read(p []byte) (int, error) {
+	for r.pending.Len() == 0 {
+		var head [5]byte
+		if _, err := io.ReadFull(r.src, head[:]); err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(head[1:])
+		if length > maxGrpcMessage {
+			return 0, errGrpcTooLarge
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r.src, payload); err != nil {
+			return 0, err
+		}
+		compressed, out, drop, err := r.transform(head[0]&1 == 1, payload)
+		if err != nil {
+			return 0, err
+		}
+		if drop {
+			continue
+		}
+		head[0] = 0
+		if compressed {
+			head[0] = 1
+		}
+		binary.BigEndian.PutUint32(head[1:], uint32(len(out)))
+		r.pending.Write(head[:])
+		r.pending.Write(out)
+	}
+	return r.pending.Read(p)
+}
+
+func (r *grpcReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// echoDescriptorSet test.EchoService/Say(stream Echo) returns (stream Echo)，Echo 只有一个 string text = 1
+func echoDescriptorSet(t *testing.T) []byte {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("echo.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Echo"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("text"),
+				JsonName: proto.String("text"),
+				Number:   proto.Int32(1),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("EchoService"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:            proto.String("Say"),
+				InputType:       proto.String(".test.Echo"),
+				OutputType:      proto.String(".test.Echo"),
+				ClientStreaming: proto.Bool(true),
+				ServerStreaming: proto.Bool(true),
+			}},
+		}},
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// grpcFrame 按 gRPC 长度前缀帧编码 Echo{text}
+func grpcFrame(text string) []byte {
+	message := append([]byte{0x0a, byte(len(text))}, text...)
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+func TestGrpcIntercept(t *testing.T) {
+	// 双向流回显服务：每收到一条消息立即原样返回
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		reader := &grpcReader{src: r.Body, transform: func(compressed bool, payload []byte) (bool, []byte, bool, error) {
+			return compressed, payload, false, nil
+		}}
+		buf := make([]byte, 1024)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				_, _ = w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				break
+			}
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	certificate := newTestCertificate(t)
+	server := NewServer("")
+	server.ConfigCertificate(certificate)
+	server.ConfigHttps(true)
+	server.ConfigHTTP2(true)
+	var lock sync.Mutex
+	var responses []string
+	err := server.ConfigGrpc(echoDescriptorSet(t), func(data model.GrpcMessage) model.GrpcMessage {
+		if data.Method != "/test.EchoService/Say" {
+			t.Errorf("unexpected method %s", data.Method)
+		}
+		// protojson 的输出会随机插入空格，比较前去掉
+		text := strings.ReplaceAll(data.Json, " ", "")
+		if !data.Upstream {
+			lock.Lock()
+			responses = append(responses, text)
+			lock.Unlock()
+			return data
+		}
+		switch text {
+		case `{"text":"drop"}`:
+			data.Drop = true
+		case `{"text":"clear"}`:
+			// 改写为字段都是默认值的消息，编码后为空
+			return model.GrpcMessage{Modified: true}
+		case `{"text":"hello"}`:
+			data.Json = `{"text":"HELLO"}`
+		}
+		return data
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.RootCa)
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+
+	body := strings.Join([]string{string(grpcFrame("hello")), string(grpcFrame("drop")), string(grpcFrame("clear")), string(grpcFrame("world"))}, "")
+	request, _ := http.NewRequest(http.MethodPost, origin.URL+"/test.EchoService/Say", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Te", "trailers")
+	resp, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if want := string(grpcFrame("HELLO")) + string(make([]byte, 5)) + string(grpcFrame("world")); string(data) != want {
+		t.Fatalf("unexpected body %q", data)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("missing grpc-status trailer %v", resp.Trailer)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(responses) != 3 || responses[0] != `{"text":"HELLO"}` || responses[1] != `{}` || responses[2] != `{"text":"world"}` {
+		t.Fatalf("unexpected decoded responses %v", responses)
+	}
+}
+
+func TestGrpcH2C(t *testing.T) {
+	// 明文 gRPC 源站要求 HTTP/2
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	origin.Config.Protocols = new(http.Protocols)
+	origin.Config.Protocols.SetHTTP1(true)
+	origin.Config.Protocols.SetUnencryptedHTTP2(true)
+	origin.Start()
+	defer origin.Close()
+
+	server := NewServer("")
+	server.ConfigH2C(true)
+	err := server.ConfigGrpc(echoDescriptorSet(t), func(data model.GrpcMessage) model.GrpcMessage {
+		if data.Upstream {
+			data.Json = strings.Replace(data.Json, "hello", "HELLO", 1)
+		}
+		return data
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	// 客户端以 h2c prior knowledge 连接代理
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", proxyAddr)
+		},
+	}}
+	request, _ := http.NewRequest(http.MethodPost, origin.URL+"/test.EchoService/Say", bytes.NewReader(grpcFrame("hello")))
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Te", "trailers")
+	resp, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(data) != string(grpcFrame("HELLO")) {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, data)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("missing grpc-status trailer %v", resp.Trailer)
+	}
+}
+
+func TestIsGrpc(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/grpc":                true,
+		"application/grpc+proto":          true,
+		"application/grpc; charset=utf-8": true,
+		"Application/GRPC+json":           true,
+		"application/grpc-web":            false,
+		"application/grpc-web+proto":      false,
+		"application/grpc-web-text":       false,
+		"application/grpc-web-text+proto": false,
+		"application/json":                false,
+		"":                                false,
+	} {
+		header := http.Header{"Content-Type": []string{contentType}}
+		if got := isGrpc(header); got != want {
+			t.Errorf("%q: want %v, got %v", contentType, want, got)
+		}
+	}
+}
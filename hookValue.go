@@ -0,0 +1,10 @@
+package proxy
+
+// hookValue 按钩子返回值约定（见 model.EventData）取改写后的内容：modified 为 true 或 value 非空时使用 value，
+// 否则保留 original，因此钩子直接返回零值表示不改写
+func hookValue[T ~string | ~[]byte](value, original T, modified bool) T {
+	if modified || len(value) > 0 {
+		return value
+	}
+	return original
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+	"github.com/xyjwsj/request-proxy/util"
+	"golang.org/x/net/http2"
+)
+
+// ConfigHTTP2 开启后解密 HTTPS 时通过 ALPN 与客户端协商 HTTP/2，每个流单独经过请求和响应钩子；
+// 与上游使用 HTTP/2 还是 HTTP/1.1 由上游连接池决定
+func (s *Server) ConfigHTTP2(enable bool) {
+	s.config.http2 = enable
+}
+
+// mitmProtos 与客户端握手时声明的 ALPN，未开启 HTTP/2 时不声明
+func (s *Server) mitmProtos() []string {
+	if s.config.http2 {
+		return []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	return nil
+}
+
+// canMitm 客户端 ALPN 中是否有代理能解密处理的协议
+func (s *Server) canMitm(protos []string) bool {
+	if supportsHTTP1(protos) {
+		return true
+	}
+	if s.config.http2 {
+		for _, proto := range protos {
+			if proto == http2.NextProtoTLS {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveHTTP2 在协商了 h2 的 TLS 连接或完成 h2c 升级的明文连接上处理所有流，连接关闭后返回。
+// opts 为 nil 表示 ALPN 协商，h2c 升级时携带升级请求和 HTTP2-Settings
+func (s *Server) serveHTTP2(wrapReq model.WrapRequest, conn net.Conn, opts *http2.ServeConnOpts) {
+	clearDeadline(conn)
+	if opts == nil {
+		opts = &http2.ServeConnOpts{}
+	}
+	// 有流在处理时连接为活动状态，全部结束后为空闲状态，停机时可以关闭
+	var lock sync.Mutex
+	streams := 0
+	server := &http2.Server{IdleTimeout: s.config.idleTimeout}
+	opts.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		if streams++; streams == 1 {
+			s.setConnState(wrapReq, stateActive)
+		}
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			if streams--; streams == 0 {
+				s.setConnState(wrapReq, stateIdle)
+			}
+			lock.Unlock()
+		}()
+
+		stream := wrapReq
+		stream.ID = util.UUID()
+		stream.Duration = 0
+		s.serveHTTP2Stream(stream, w, r)
+	})
+	server.ServeConn(conn, opts)
+}
+
+// serveHTTP2Stream 处理单个 HTTP/2 流
+func (s *Server) serveHTTP2Stream(wrapReq model.WrapRequest, w http.ResponseWriter, request *http.Request) {
+	if request.TLS != nil {
+		request = setRequest(wrapReq, request)
+	} else {
+		// h2c 升级后的明文流
+		request.URL.Host = request.Host
+		request.URL.Scheme = "http"
+		request = withTarget(wrapReq, request)
+	}
+	// TE: trailers 是 HTTP/2 中唯一允许的逐跳头部，gRPC 依赖它
+	te := request.Header.Get("Te")
+	removeHopHeaders(request.Header)
+	if te == "trailers" {
+		request.Header.Set("Te", te)
+	}
+	if isGrpc(request.Header) {
+		// gRPC 可能是双向流，不能缓冲
+		s.serveGrpcStream(wrapReq, w, request)
+		return
+	}
+
+	if !s.bufferFlow(wrapReq, request) {
+		milli := time.Now().UnixMilli()
+		// 流式模式下钩子返回的 Body 不生效
+		interceptorRequest(wrapReq, request, nil)
+		response, err := s.transport(request)
+		if err != nil {
+			log.Println(err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer response.Body.Close()
+		wrapReq.Duration = time.Now().UnixMilli() - milli
+		s.writeHTTP2Stream(wrapReq, w, response)
+		return
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		log.Println("Read body error:", err)
+		return
+	}
+	milli := time.Now().UnixMilli()
+	body = interceptorRequest(wrapReq, request, body)
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	request.ContentLength = int64(len(body))
+	request.Header.Del("Content-Length")
+
+	response, err := s.transport(request)
+	if err != nil {
+		log.Println(err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+	if s.streamingResponse(request, response) {
+		wrapReq.Duration = time.Now().UnixMilli() - milli
+		s.writeHTTP2Stream(wrapReq, w, response)
+		return
+	}
+	responseBody, err := readResponseBody(response.Body, response.Header)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	wrapReq.Duration = time.Now().UnixMilli() - milli
+	responseBody = interceptorResponse(wrapReq, response, responseBody)
+	out, err := encodeBody(response.Header.Get("Content-Encoding"), responseBody)
+	if err != nil {
+		log.Println(err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	removeHopHeaders(response.Header)
+	copyHeader(w.Header(), response.Header)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(response.StatusCode)
+	if _, err = w.Write(out); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	copyTrailer(w, response.Trailer)
+}
+
+// writeHTTP2Stream 调用响应钩子（不含 Body）后边收边转发响应体，最后写回上游的 trailer
+func (s *Server) writeHTTP2Stream(wrapReq model.WrapRequest, w http.ResponseWriter, response *http.Response) {
+	interceptorResponse(wrapReq, response, nil)
+
+	var body io.Reader = response.Body
+	if s.config.eventCall != nil && isEventStream(response.Header) && response.Header.Get("Content-Encoding") == "" {
+		body = newEventReader(wrapReq.ID, response.Body, s.config.eventCall)
+		response.Header.Del("Content-Length")
+	}
+
+	removeHopHeaders(response.Header)
+	copyHeader(w.Header(), response.Header)
+	w.WriteHeader(response.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				log.Println(werr.Error())
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+	}
+	copyTrailer(w, response.Trailer)
+}
+
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// copyTrailer 响应体写完后设置 trailer，未预先声明的 trailer 使用 http.TrailerPrefix
+func copyTrailer(w http.ResponseWriter, trailer http.Header) {
+	for key, values := range trailer {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
@@ -4,20 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	brotli "github.com/google/brotli/go/cbrotli"
 	"github.com/xyjwsj/request-proxy/model"
 	"github.com/xyjwsj/request-proxy/util"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -28,40 +30,109 @@ const (
 
 // HandleHTTP 处理 HTTP 请求
 func HandleHTTP(wrapReq model.WrapRequest) {
+	defaultServer.handleHTTP(wrapReq)
+}
 
-	// 解析 HTTP 请求
-	req, err := http.ReadRequest(wrapReq.Reader)
-	if err != nil {
-		log.Println("Read request error:", err)
-		return
+func (s *Server) handleHTTP(wrapReq model.WrapRequest) {
+	s.serveRequests(wrapReq, s.serveHTTPRequest)
+}
+
+// serveRequests 在同一连接上循环读取请求，handle 返回 false 或连接空闲超时后结束
+func (s *Server) serveRequests(wrapReq model.WrapRequest, handle func(model.WrapRequest, *http.Request) bool) {
+	for first := true; ; first = false {
+		if !first {
+			// 保持连接：等待下一个请求，超过空闲时间后关闭
+			s.setConnState(wrapReq, stateIdle)
+			if s.shuttingDown() {
+				return
+			}
+			s.idleDeadline(wrapReq.Conn)
+			if _, err := wrapReq.Reader.Peek(1); err != nil {
+				return
+			}
+			wrapReq.ID = util.UUID()
+			wrapReq.Duration = 0
+		}
+
+		// 解析 HTTP 请求
+		s.readDeadline(wrapReq.Conn)
+		req, err := http.ReadRequest(wrapReq.Reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Read request error:", err)
+			}
+			return
+		}
+		s.setConnState(wrapReq, stateActive)
+
+		keepAlive := handle(wrapReq, req)
+		_ = req.Body.Close()
+		if !keepAlive {
+			return
+		}
 	}
-	defer req.Body.Close()
+}
 
-	if wrapReq.Https && req.Method == "CONNECT" { // 打开https代理才能支持转发
-		// 处理 CONNECT 请求（HTTPS 隧道）
-		handleCONNECT(wrapReq, req)
-		return
+// serveHTTPRequest 处理单个明文 HTTP 请求，返回连接是否可以继续复用
+func (s *Server) serveHTTPRequest(wrapReq model.WrapRequest, req *http.Request) bool {
+	if target := s.reverse.Load(); target != nil {
+		if req.Method == http.MethodConnect {
+			s.writeDeadline(wrapReq.Conn)
+			_, _ = io.WriteString(wrapReq.Conn, "HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+			return false
+		}
+		req = target.rewriteRequest(req, util.GetClientIP(wrapReq.Conn))
+	}
+	if wrapReq.Target != "" && req.URL.Host == "" {
+		// 透明代理模式下客户端发送的是 origin-form 请求
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = wrapReq.Target
+		}
+	}
+	req = withTarget(wrapReq, req)
+
+	if req.Method == "CONNECT" {
+		if wrapReq.Https && s.shouldIntercept(req.URL.Host) { // 打开https代理且规则允许才解密
+			// 处理 CONNECT 请求（HTTPS 隧道）
+			s.handleCONNECT(wrapReq, req)
+		} else {
+			s.handleTunnel(wrapReq, req)
+		}
+		return false
 	}
 
 	if req.Host == SslDownloadHost && req.URL.Path == "/ssl" {
+		rootCa := s.rootCertificate().RootCaStr
 		response := &http.Response{
 			StatusCode: http.StatusOK,
 			Header: http.Header{
 				"Content-Type":        []string{"text/plain"},
 				"Content-Disposition": []string{"attachment; filename=" + util.CertDownload},
-				"Content-Length":      []string{strconv.Itoa(len(util.Cert.RootCaStr))},
+				"Content-Length":      []string{strconv.Itoa(len(rootCa))},
 			},
-			ContentLength: int64(len(util.Cert.RootCaStr)),
-			Body:          io.NopCloser(bytes.NewReader(util.Cert.RootCaStr)),
+			ContentLength: int64(len(rootCa)),
+			Body:          io.NopCloser(bytes.NewReader(rootCa)),
 		}
-		util.WriteFullResponse(wrapReq.Conn, response)
-		return
+		setKeepAliveHeader(req, response.Header)
+		s.writeDeadline(wrapReq.Conn)
+		return util.WriteFullResponse(wrapReq.Conn, response) == nil && !req.Close
+	}
+
+	if isUpgrade(req.Header) {
+		s.handleUpgrade(wrapReq, req)
+		return false
+	}
+
+	if !s.bufferFlow(wrapReq, req) {
+		return s.streamRequest(wrapReq, req)
 	}
 
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
 		log.Println("Read body error:", err)
-		return
+		return false
 	}
 	milli := time.Now().UnixMilli()
 	body = interceptorRequest(wrapReq, req, body)
@@ -72,28 +143,92 @@ func HandleHTTP(wrapReq model.WrapRequest) {
 	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
 	// ----------------------------------
 
-	response, err := transport(req)
+	clientClose := req.Close
+	removeHopHeaders(req.Header)
+	response, err := s.transport(req)
+	if err != nil {
+		log.Println(err.Error())
+		s.writeDeadline(wrapReq.Conn)
+		return writeBadGateway(wrapReq.Conn, clientClose) == nil && !clientClose
+	}
+	defer response.Body.Close()
+	if s.streamingResponse(req, response) {
+		wrapReq.Duration = time.Now().UnixMilli() - milli
+		return s.writeStreamResponse(wrapReq, req, response, clientClose)
+	}
 
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
 		log.Println(err.Error())
-		return
+		return false
 	}
 
 	wrapReq.Duration = time.Now().UnixMilli() - milli
 	responseBody = interceptorResponse(wrapReq, response, responseBody)
 
-	response.Body = io.NopCloser(bytes.NewReader(responseBody))
+	removeHopHeaders(response.Header)
+	setKeepAliveHeader(req, response.Header)
+	response.Close = clientClose
 	response.Header.Set("Content-Length", strconv.Itoa(len(responseBody)))
 	response.ContentLength = int64(len(responseBody))
+	response.TransferEncoding = nil
 	response.Body = io.NopCloser(bytes.NewReader(responseBody))
+	s.writeDeadline(wrapReq.Conn)
 	err = response.Write(wrapReq.Conn)
 	if err != nil {
 		log.Println(err.Error())
-		return
+		return false
+	}
+	return !clientClose
+}
+
+// hopHeaders 逐跳头部，只对当前连接有效，不能转发
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders 删除逐跳头部以及 Connection 中声明的头部
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// setKeepAliveHeader HTTP/1.0 客户端需要显式的 keep-alive 响应头才会复用连接
+func setKeepAliveHeader(req *http.Request, header http.Header) {
+	if !req.Close && !req.ProtoAtLeast(1, 1) {
+		header.Set("Connection", "keep-alive")
 	}
 }
 
+// writeBadGateway 上游不可用时返回 502
+func writeBadGateway(w io.Writer, close bool) error {
+	response := &http.Response{
+		StatusCode:    http.StatusBadGateway,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: 0,
+		Close:         close,
+	}
+	return response.Write(w)
+}
+
 func interceptorResponse(wrapReq model.WrapRequest, response *http.Response, responseBody []byte) []byte {
 	if wrapReq.OnResponse != nil {
 		resData := model.ResponseData{
@@ -102,6 +237,7 @@ func interceptorResponse(wrapReq model.WrapRequest, response *http.Response, res
 			Header:   response.Header,
 			Body:     string(responseBody),
 			Duration: wrapReq.Duration,
+			Backend:  reverseBackendStats(response),
 		}
 		onResponse := wrapReq.OnResponse(resData)
 		if onResponse.Code >= 0 {
@@ -122,24 +258,28 @@ func interceptorResponse(wrapReq model.WrapRequest, response *http.Response, res
 	return responseBody
 }
 
+// newRequestData 构建交给钩子的请求数据，不包含 TargetIp
+func newRequestData(wrapReq model.WrapRequest, req *http.Request, body []byte) model.RequestData {
+	protocol := "http"
+	if wrapReq.Https {
+		protocol = "https"
+	}
+	return model.RequestData{
+		ID:       wrapReq.ID,
+		Protocol: protocol,
+		ClientIp: util.GetClientIP(wrapReq.Conn),
+		Host:     req.Host,
+		Url:      req.URL.Path,
+		Method:   req.Method,
+		Header:   req.Header,
+		Query:    req.URL.Query(),
+		Body:     string(body),
+	}
+}
+
 func interceptorRequest(wrapReq model.WrapRequest, req *http.Request, body []byte) []byte {
 	if wrapReq.OnRequest != nil {
-		protocol := "http"
-		if wrapReq.Https {
-			protocol = "https"
-		}
-		reqData := model.RequestData{
-			ID:       wrapReq.ID,
-			Protocol: protocol,
-			ClientIp: util.GetClientIP(wrapReq.Conn),
-			Host:     req.Host,
-			Url:      req.URL.Path,
-			Method:   req.Method,
-			Header:   req.Header,
-			Query:    req.URL.Query(),
-			Body:     string(body),
-		}
-
+		reqData := newRequestData(wrapReq, req, body)
 		domain, _ := util.GetIPFromDomain(reqData.Host)
 		if domain != nil && len(domain) > 0 {
 			reqData.TargetIp = domain[0]
@@ -164,36 +304,116 @@ func interceptorRequest(wrapReq model.WrapRequest, req *http.Request, body []byt
 	return body
 }
 
-func handleCONNECT(wrapReq model.WrapRequest, req *http.Request) {
-	host := req.URL.Host
+// handleCONNECT 开启 https 时的 CONNECT：不预先连接目标，先识别客户端首个记录，
+// TLS ClientHello 解密后经上游连接池转发，目标不可达时由每个请求返回 502；
+// 其他协议（含服务端先发言的协议）按原始隧道转发，数据流钩子照常生效
+func (s *Server) handleCONNECT(wrapReq model.WrapRequest, req *http.Request) {
+	// 返回 200 Connection established 响应
+	_, err := fmt.Fprint(wrapReq.Writer, ConnectSuccess)
+	if err != nil {
+		log.Println("Write 200 failed:", err)
+		_, err = fmt.Fprint(wrapReq.Writer, ConnectFailed)
+		return
+	}
+	_ = wrapReq.Writer.Flush() // 立即刷新 buffer，确保响应已发送
 
-	// 2. 连接到目标服务器（例如：example.com:443）
-	serverConn, err := net.Dial("tcp", host)
+	protocols := []ProtocolDetector{{Name: "tls", Detect: detectTLS, Handle: func(wrapReq model.WrapRequest) {
+		s.mitm(wrapReq, req.Host)
+	}}}
+	if protocol := detectWithin(wrapReq, protocols); protocol != nil {
+		protocol.Handle(wrapReq)
+		return
+	}
+	host := req.URL.Host
+	serverConn, err := s.dialContext(context.Background(), "tcp", host)
 	if err != nil {
 		log.Println("Dial to remote server failed:", err)
 		return
 	}
-	serverConn.Close()
+	defer serverConn.Close()
+	s.tunnel(wrapReq, model.TunnelConnect, host, serverConn)
+}
 
-	// 1. 返回 200 Connection established 响应
-	_, err = fmt.Fprint(wrapReq.Writer, ConnectSuccess)
+// handleTunnel 未开启 https 时的 CONNECT：不解密，直接在客户端和目标之间转发字节
+func (s *Server) handleTunnel(wrapReq model.WrapRequest, req *http.Request) {
+	host := req.URL.Host
+	serverConn, err := s.dialContext(context.Background(), "tcp", host)
 	if err != nil {
-		log.Println("Write 200 failed:", err)
-		_, err = fmt.Fprint(wrapReq.Writer, ConnectFailed)
+		log.Println("Dial to remote server failed:", err)
+		_, _ = fmt.Fprint(wrapReq.Writer, ConnectFailed)
+		_ = wrapReq.Writer.Flush()
 		return
 	}
-	_ = wrapReq.Writer.Flush() // 立即刷新 buffer，确保响应已发送
+	defer serverConn.Close()
+
+	if _, err = fmt.Fprint(wrapReq.Writer, ConnectSuccess); err != nil {
+		return
+	}
+	if err = wrapReq.Writer.Flush(); err != nil {
+		return
+	}
+	s.tunnel(wrapReq, model.TunnelConnect, host, serverConn)
+}
 
-	certificate, err := Cache.GetCertificate(req.Host, "443")
+// mitm 使用子证书与客户端完成 TLS 握手，然后循环处理解密后的请求
+func (s *Server) mitm(wrapReq model.WrapRequest, host string) {
+	tlsConfig, err := s.mitmTLSConfig(host)
 	if err != nil {
-		log.Println(req.Host + "：获取证书失败：" + err.Error())
+		log.Println(host + "：获取证书失败：" + err.Error())
 		return
 	}
-	if _, ok := certificate.(tls.Certificate); !ok {
+	sslConn := tls.Server(&util.BufferedConn{Conn: wrapReq.Conn, Reader: wrapReq.Reader}, tlsConfig)
+	// ssl校验
+	s.readDeadline(wrapReq.Conn)
+	err = sslConn.Handshake()
+	if err != nil {
+		log.Println("Handshake error:" + err.Error())
+		if rejectedCertificate(err) {
+			s.learner.recordHandshakeFailure(host, util.GetClientIP(wrapReq.Conn), err)
+		}
+		return
+	}
+
+	// 握手成功但在首个请求前断开，多为证书固定的客户端（如 OkHttp）校验失败后直接关闭连接
+	reader := bufio.NewReader(sslConn)
+	if _, err = reader.Peek(1); err != nil {
+		if closedBeforeRequest(err) {
+			s.learner.recordHandshakeFailure(host, util.GetClientIP(wrapReq.Conn), errors.New("client closed before first request"))
+		}
+		return
+	}
+
+	wrapReq.Conn = sslConn
+	if sslConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		s.serveHTTP2(wrapReq, &bufferedTLSConn{Conn: sslConn, reader: reader}, nil)
 		return
 	}
-	cert := certificate.(tls.Certificate)
-	sslConn := tls.Server(wrapReq.Conn, &tls.Config{
+	wrapReq.Reader = reader
+	wrapReq.Writer = bufio.NewWriter(wrapReq.Conn)
+	s.serveRequests(wrapReq, s.serveHTTPSRequest)
+}
+
+// bufferedTLSConn 读取时先消费已缓冲的数据，保留 *tls.Conn 的 ConnectionState 以便 HTTP/2 请求带有 TLS 信息
+type bufferedTLSConn struct {
+	*tls.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedTLSConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// mitmTLSConfig 使用根证书签发的子证书构建与客户端握手的 TLS 配置
+func (s *Server) mitmTLSConfig(host string) (*tls.Config, error) {
+	certificate, err := s.cache.GetCertificate(host, "443")
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := certificate.(tls.Certificate)
+	if !ok {
+		return nil, errors.New("Certificate Error")
+	}
+	return &tls.Config{
 		MinVersion: tls.VersionTLS10, // 支持 TLS 1.0~1.3
 		MaxVersion: tls.VersionTLS13,
 		CipherSuites: []uint16{
@@ -203,10 +423,11 @@ func handleCONNECT(wrapReq model.WrapRequest, req *http.Request) {
 			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
 		},
 		PreferServerCipherSuites: true,
+		NextProtos:               s.mitmProtos(),
 		Certificates:             []tls.Certificate{cert},
 		GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			host := info.ServerName
-			cert, err := Cache.GetCertificate(host, "443")
+			cert, err := s.cache.GetCertificate(host, "443")
 			if err != nil {
 				return nil, err
 			}
@@ -215,77 +436,69 @@ func handleCONNECT(wrapReq model.WrapRequest, req *http.Request) {
 			}
 			return nil, errors.New("Certificate Error")
 		},
-	})
-	// ssl校验
-	err = sslConn.Handshake()
-	if err != nil {
-		log.Println("Handshake error:" + err.Error())
+	}, nil
+}
+
+// serveHTTPSRequest 处理 TLS 隧道内解密后的单个请求，返回连接是否可以继续复用
+func (s *Server) serveHTTPSRequest(wrapReq model.WrapRequest, request *http.Request) bool {
+	if isUpgrade(request.Header) {
+		s.handleUpgrade(wrapReq, setRequest(wrapReq, request))
+		return false
+	}
+	if !s.bufferFlow(wrapReq, request) {
+		return s.streamRequest(wrapReq, setRequest(wrapReq, request))
 	}
 
-	wrapReq.Conn = sslConn
-	wrapReq.Reader = bufio.NewReader(wrapReq.Conn)
-	wrapReq.Writer = bufio.NewWriter(wrapReq.Conn)
-	request, err := http.ReadRequest(wrapReq.Reader)
+	body, err := io.ReadAll(request.Body)
 	if err != nil {
-		log.Println(err.Error())
-		return
+		log.Println("Read body error:", err)
+		return false
 	}
-
-	body, _ := io.ReadAll(request.Body)
-	log.Println(string(body))
-	request.Body = io.NopCloser(bytes.NewReader(body))
-	request = setRequest(request)
+	clientClose := request.Close
+	removeHopHeaders(request.Header)
+	request = setRequest(wrapReq, request)
 
 	milli := time.Now().UnixMilli()
 	body = interceptorRequest(wrapReq, request, body)
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	request.ContentLength = int64(len(body))
 
-	response, err := transport(request)
+	response, err := s.transport(request)
 	if err != nil {
 		log.Println(err.Error())
-		return
+		s.writeDeadline(wrapReq.Conn)
+		return writeBadGateway(wrapReq.Conn, clientClose) == nil && !clientClose
+	}
+	defer response.Body.Close()
+	if s.streamingResponse(request, response) {
+		wrapReq.Duration = time.Now().UnixMilli() - milli
+		return s.writeStreamResponse(wrapReq, request, response, clientClose)
 	}
 	responseBody, err := readResponseBody(response.Body, response.Header)
 	if err != nil {
 		log.Println(err.Error())
-		return
+		return false
 	}
 
 	wrapReq.Duration = time.Now().UnixMilli() - milli
 	responseBody = interceptorResponse(wrapReq, response, responseBody)
 
+	removeHopHeaders(response.Header)
+	setKeepAliveHeader(request, response.Header)
+	response.Close = clientClose
+	s.writeDeadline(wrapReq.Conn)
 	err = writeCompressedResponse(response, responseBody, wrapReq.Conn)
-
-	//response.Body = io.NopCloser(bytes.NewReader(responseBody))
-	//response.Header.Set("Content-Length", strconv.Itoa(len(responseBody)))
-	//response.ContentLength = int64(len(responseBody))
-	//response.Body = io.NopCloser(bytes.NewReader(responseBody))
-	//err = response.Write(wrapReq.Conn)
 	if err != nil {
 		log.Println(err.Error())
-		return
-	}
-	log.Println("END")
-}
-
-func transport(request *http.Request) (*http.Response, error) {
-	// 去除一些头部
-	response, err := (&http.Transport{
-		DisableKeepAlives:     true,
-		ResponseHeaderTimeout: 60 * time.Second,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-	}).RoundTrip(request)
-	if err != nil {
-		return nil, err
+		return false
 	}
-	// 去除一些头部
-	return response, err
+	return !clientClose
 }
 
-func setRequest(request *http.Request) *http.Request {
-	request.Header.Set("Connection", "false")
+func setRequest(wrapReq model.WrapRequest, request *http.Request) *http.Request {
 	request.URL.Host = request.Host
 	request.URL.Scheme = "https"
-	return request
+	return withTarget(wrapReq, request)
 }
 
 func readResponseBody(body io.ReadCloser, header http.Header) ([]byte, error) {
@@ -307,50 +520,44 @@ func readResponseBody(body io.ReadCloser, header http.Header) ([]byte, error) {
 }
 
 func writeCompressedResponse(resp *http.Response, body []byte, w io.Writer) error {
-	var out io.Writer = &bytes.Buffer{}
-	var err error
+	out, err := encodeBody(resp.Header.Get("Content-Encoding"), body)
+	if err != nil {
+		return err
+	}
+
+	// 设置新的 Body 和 Content-Length
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	resp.Header.Del("Transfer-Encoding")
+	resp.TransferEncoding = nil
+
+	// 写回客户端
+	return resp.Write(w)
+}
 
-	// 判断原始响应是否使用了压缩
-	switch resp.Header.Get("Content-Encoding") {
+// encodeBody 按原始响应的 Content-Encoding 重新压缩响应体
+func encodeBody(encoding string, body []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	switch encoding {
 	case "gzip":
 		gzw := gzip.NewWriter(out)
-		_, err = gzw.Write(body)
-		if err != nil {
-			return err
+		if _, err := gzw.Write(body); err != nil {
+			return nil, err
 		}
-		err = gzw.Close()
-		if err != nil {
-			return err
+		if err := gzw.Close(); err != nil {
+			return nil, err
 		}
-		resp.Header.Set("Content-Encoding", "gzip")
-
 	case "br":
 		brw := brotli.NewWriter(out, brotli.WriterOptions{})
-		_, err = brw.Write(body)
-		if err != nil {
-			return err
+		if _, err := brw.Write(body); err != nil {
+			return nil, err
 		}
-		err = brw.Close()
-		if err != nil {
-			return err
+		if err := brw.Close(); err != nil {
+			return nil, err
 		}
-		resp.Header.Set("Content-Encoding", "br")
-
 	default:
-		out = bytes.NewBuffer(body)
+		return body, nil
 	}
-
-	// 设置新的 Body 和 Content-Length
-	resp.Body = io.NopCloser(out.(io.Reader))
-	resp.ContentLength = int64(out.(*bytes.Buffer).Len())
-	resp.Header.Set("Content-Length", strconv.Itoa(out.(*bytes.Buffer).Len()))
-	resp.Header.Del("Transfer-Encoding")
-
-	// 写回客户端
-	err = resp.Write(w)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return out.Bytes(), nil
 }
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// hostRule 拦截规则：主机名、通配符（*.example.com）、IP、CIDR，可以附加端口（example.com:443）
+type hostRule struct {
+	raw    string
+	host   string     // 小写主机名或 IP，"*" 匹配所有主机
+	suffix string     // 通配符后缀，例如 ".example.com"
+	ipNet  *net.IPNet // CIDR
+	port   int        // 0 匹配所有端口
+}
+
+// interceptPolicy deny 命中的目标原样转发；allow 非空时只有命中的目标才解密
+type interceptPolicy struct {
+	allow []hostRule
+	deny  []hostRule
+	cidr  bool // 是否包含 CIDR 规则，决定是否需要解析域名
+}
+
+// ConfigIntercept 替换 https 拦截规则，运行中调用立即生效。
+// deny 命中的目标不解密直接转发；allow 不为空时只解密命中的目标。
+// 规则格式：example.com、*.example.com、10.0.0.1、10.0.0.0/8、[::1]，可以附加 :端口，端口单独写作 *:8443
+func (s *Server) ConfigIntercept(allow, deny []string) error {
+	policy := &interceptPolicy{}
+	for _, rules := range []struct {
+		raw    []string
+		target *[]hostRule
+	}{{allow, &policy.allow}, {deny, &policy.deny}} {
+		for _, raw := range rules.raw {
+			rule, err := parseHostRule(raw)
+			if err != nil {
+				return err
+			}
+			if rule.ipNet != nil {
+				policy.cidr = true
+			}
+			*rules.target = append(*rules.target, rule)
+		}
+	}
+	s.policy.Store(policy)
+	return nil
+}
+
+// InterceptRules 返回当前生效的拦截规则
+func (s *Server) InterceptRules() (allow, deny []string) {
+	policy := s.policy.Load()
+	if policy == nil {
+		return nil, nil
+	}
+	for _, rule := range policy.allow {
+		allow = append(allow, rule.raw)
+	}
+	for _, rule := range policy.deny {
+		deny = append(deny, rule.raw)
+	}
+	return allow, deny
+}
+
+// shouldIntercept 按规则和自动学习的直接转发列表判断 target（host:port）是否解密，调用方仍需检查 https 开关
+func (s *Server) shouldIntercept(target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host, portStr = target, "443"
+	}
+	host = normalizeHost(host)
+	if s.learner.passthrough(host) {
+		return false
+	}
+	policy := s.policy.Load()
+	if policy == nil {
+		return true
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	ips := ruleIPs(host, policy.cidr)
+	if matchRules(policy.deny, host, ips, port) {
+		return false
+	}
+	if len(policy.allow) > 0 {
+		return matchRules(policy.allow, host, ips, port)
+	}
+	return true
+}
+
+// ruleIPs 目标的 IP，用于匹配 CIDR 规则；resolve 为 false 时不解析域名
+func ruleIPs(host string, resolve bool) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	if resolve {
+		ips, _ := net.LookupIP(host)
+		return ips
+	}
+	return nil
+}
+
+func matchRules(rules []hostRule, host string, ips []net.IP, port int) bool {
+	for _, rule := range rules {
+		if rule.match(host, ips, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r hostRule) match(host string, ips []net.IP, port int) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	switch {
+	case r.ipNet != nil:
+		for _, ip := range ips {
+			if r.ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	case r.suffix != "":
+		return strings.HasSuffix(host, r.suffix)
+	case r.host == "*":
+		return true
+	default:
+		if ip := net.ParseIP(r.host); ip != nil {
+			return ip.Equal(net.ParseIP(host))
+		}
+		return r.host == host
+	}
+}
+
+// parseHostRule 解析单条规则
+func parseHostRule(raw string) (hostRule, error) {
+	rule := hostRule{raw: raw}
+	value := strings.ToLower(strings.TrimSpace(raw))
+	if value == "" {
+		return rule, fmt.Errorf("empty intercept rule")
+	}
+
+	// 拆出端口：[v6]:port、host:port、cidr:port；不带方括号的 IPv6 不能带端口
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]")
+		if end < 0 {
+			return rule, fmt.Errorf("invalid intercept rule %q", raw)
+		}
+		if rest := value[end+1:]; rest != "" {
+			port, err := parsePort(strings.TrimPrefix(rest, ":"))
+			if err != nil {
+				return rule, fmt.Errorf("invalid intercept rule %q: %w", raw, err)
+			}
+			rule.port = port
+		}
+		value = value[1:end]
+	} else if strings.Count(value, ":") == 1 {
+		host, portStr, _ := strings.Cut(value, ":")
+		port, err := parsePort(portStr)
+		if err != nil {
+			return rule, fmt.Errorf("invalid intercept rule %q: %w", raw, err)
+		}
+		value, rule.port = host, port
+	}
+	if value == "" {
+		value = "*"
+	}
+
+	switch {
+	case strings.Contains(value, "/"):
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return rule, fmt.Errorf("invalid intercept rule %q: %w", raw, err)
+		}
+		rule.ipNet = ipNet
+	case strings.HasPrefix(value, "*."):
+		rule.suffix = value[1:]
+	default:
+		rule.host = strings.TrimSuffix(value, ".")
+	}
+	return rule, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", value)
+	}
+	return port, nil
+}
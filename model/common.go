@@ -28,17 +28,137 @@ type ResponseData struct {
 	Header   map[string][]string `json:"header"`
 	Body     string              `json:"body"`
 	Duration int64               `json:"duration"`
+	Backend  *BackendStats       `json:"backend,omitempty"` // 反向代理模式下处理该请求的后端
+}
+
+// BackendStats 反向代理后端的统计
+type BackendStats struct {
+	URL      string `json:"url"`
+	Healthy  bool   `json:"healthy"`  // 最近一次主动健康检查是否通过
+	Ejected  bool   `json:"ejected"`  // 是否因连续失败被暂时摘除
+	Active   int64  `json:"active"`   // 处理中的请求数
+	Requests int64  `json:"requests"` // 累计请求数
+	Failures int64  `json:"failures"` // 累计失败数（连接错误和 502/503/504）
 }
 
 type RequestCall func(data RequestData) RequestData
 type ResponseCall func(data ResponseData) ResponseData
 
+// EventData SSE 响应中的单个事件，Drop 丢弃整个事件。
+// 钩子返回值约定：Modified 为 false 时返回的空内容（Event、Data 等字段或 Payload）表示不改写，钩子可以直接返回零值；
+// 需要改写为空内容时设置 Modified
+type EventData struct {
+	ID       string `json:"ID"` // 所属请求 ID
+	Event    string `json:"event"`
+	Data     string `json:"data"`
+	EventID  string `json:"eventId"`
+	Retry    string `json:"retry"`
+	Drop     bool   `json:"drop"`     // 钩子返回 true 时丢弃该事件
+	Modified bool   `json:"modified"` // 钩子返回 true 时按返回的字段发送，空字段也生效
+}
+
+type EventCall func(data EventData) EventData
+
+// 隧道来源
+const (
+	TunnelConnect = "connect" // HTTP CONNECT
+	TunnelSocks   = "socks"   // SOCKS4/SOCKS5 CONNECT
+	TunnelSni     = "sni"     // 未经 CONNECT 的 TLS 连接
+	TunnelUpgrade = "upgrade" // HTTP Upgrade 返回 101 之后的字节转发
+	TunnelRaw     = "raw"     // 透明代理模式下既不是 HTTP 也不是 TLS 的连接
+)
+
+// TunnelData 不解密转发的隧道结束后的统计
+type TunnelData struct {
+	ID       string `json:"ID"`
+	Protocol string `json:"protocol"`
+	ClientIp string `json:"clientIp"`
+	Host     string `json:"host"`     // 目标 host:port
+	Upgrade  string `json:"upgrade"`  // 升级后的协议，仅 TunnelUpgrade
+	BytesOut int64  `json:"bytesOut"` // 客户端发往目标的字节数
+	BytesIn  int64  `json:"bytesIn"`  // 目标返回客户端的字节数
+	Duration int64  `json:"duration"` // 毫秒
+}
+
+type TunnelCall func(data TunnelData)
+
+// DatagramData SOCKS5 UDP 关联中的单个数据报，钩子返回空 Target 表示不改写，Drop 丢弃该数据报；Payload 的返回值约定同 EventData
+type DatagramData struct {
+	ID       string `json:"ID"` // 所属关联 ID
+	ClientIp string `json:"clientIp"`
+	Target   string `json:"target"`   // 远端地址 host:port，上行时可改写
+	Upstream bool   `json:"upstream"` // true 为客户端发往远端，false 为远端发回客户端
+	Payload  []byte `json:"payload"`
+	Drop     bool   `json:"drop"`     // 钩子返回 true 时丢弃该数据报
+	Modified bool   `json:"modified"` // 钩子返回 true 时按返回的 Payload 发送，可以为空
+}
+
+type DatagramCall func(data DatagramData) DatagramData
+
+// StreamChunk 不解密的 TCP 隧道中一次读到的数据，Drop 丢弃这段数据，Payload 的返回值约定同 EventData
+type StreamChunk struct {
+	ID       string `json:"ID"`       // 所属连接 ID
+	Protocol string `json:"protocol"` // 隧道来源，同 TunnelData.Protocol
+	ClientIp string `json:"clientIp"`
+	Host     string `json:"host"`     // 目标 host:port
+	Upstream bool   `json:"upstream"` // true 为客户端发往目标，false 为目标发回客户端
+	Offset   int64  `json:"offset"`   // 该方向上此前已读到的字节数
+	Payload  []byte `json:"payload"`  // 钩子可改写，改写后的内容原样发送
+	Drop     bool   `json:"drop"`     // 钩子返回 true 时丢弃这段数据
+	Modified bool   `json:"modified"` // 钩子返回 true 时按返回的 Payload 发送，可以为空
+}
+
+type StreamCall func(chunk StreamChunk) StreamChunk
+
+// WebSocket 消息类型，与帧 opcode 一致
+const (
+	WebSocketText   = 1
+	WebSocketBinary = 2
+)
+
+// WebSocketMessage WebSocket 连接中的一条完整消息，分片已合并，permessage-deflate 已解压。
+// Drop 丢弃该消息，Payload 的返回值约定同 EventData
+type WebSocketMessage struct {
+	ID       string `json:"ID"` // 所属握手请求 ID
+	Host     string `json:"host"`
+	Url      string `json:"url"`
+	Upstream bool   `json:"upstream"` // true 为客户端发往服务端，false 为服务端发往客户端
+	Opcode   int    `json:"opcode"`   // WebSocketText 或 WebSocketBinary
+	Payload  []byte `json:"payload"`
+	Drop     bool   `json:"drop"`     // 钩子返回 true 时丢弃该消息
+	Modified bool   `json:"modified"` // 钩子返回 true 时按返回的 Payload 发送，可以为空
+}
+
+type WebSocketCall func(data WebSocketMessage) WebSocketMessage
+
+// GrpcMessage gRPC 流中的单条消息，钩子返回空 Json 表示不改写 Json，Drop 丢弃该消息；Payload 的返回值约定同 EventData，
+// 字段都是默认值的消息编码后为空，需要设置 Modified
+type GrpcMessage struct {
+	ID       string `json:"ID"`       // 所属请求 ID
+	Method   string `json:"method"`   // 完整方法名 /package.Service/Method
+	Upstream bool   `json:"upstream"` // true 为请求消息，false 为响应消息
+	Payload  []byte `json:"payload"`  // protobuf 编码的消息，已解压
+	Json     string `json:"json"`     // 配置了描述文件时解码出的 JSON，否则为空
+	Drop     bool   `json:"drop"`     // 钩子返回 true 时丢弃该消息
+	Modified bool   `json:"modified"` // 钩子返回 true 时按返回的 Payload 发送，可以为空
+}
+
+// GrpcCall 钩子改写 Json 时按描述文件重新编码，否则使用返回的 Payload
+type GrpcCall func(data GrpcMessage) GrpcMessage
+
+// AuthCall 校验代理认证的用户名和密码
+type AuthCall func(username, password string) bool
+
+// BufferCall 流式模式下决定某个请求是否完整缓冲请求体和响应体，data 中不包含 Body
+type BufferCall func(data RequestData) bool
+
 type WrapWriter struct {
 	io.Writer
 }
 
 type WrapRequest struct {
 	ID         string
+	RawConn    net.Conn // 客户端原始连接，Conn 升级为 TLS 后仍指向它
 	Conn       net.Conn
 	Writer     *bufio.Writer
 	Reader     *bufio.Reader
@@ -46,6 +166,10 @@ type WrapRequest struct {
 	OnResponse ResponseCall
 	Https      bool
 	Duration   int64
+	Target     string // 透明代理模式下连接的原始目标 host:port，其它模式为空
+	// 客户端连接的源地址和目标地址，经 PROXY protocol 时为头部中的真实地址
+	Source      net.Addr
+	Destination net.Addr
 }
 
 type ConnResponseWriter struct {
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xyjwsj/request-proxy/util"
+	"golang.org/x/net/proxy"
+)
+
+// ParentDirect 上级代理地址写作 direct 时表示直连
+const ParentDirect = "direct"
+
+// ParentProxy 上级代理。URL 支持 http://、https://、socks5://，认证信息写在 user:pass@ 中；
+// Hosts 为目标规则，格式同 ConfigIntercept，为空时匹配所有目标
+type ParentProxy struct {
+	URL   string
+	Hosts []string
+}
+
+// parentRoute 解析后的上级代理，url 为 nil 表示直连
+type parentRoute struct {
+	url   *url.URL
+	rules []hostRule
+}
+
+type parentChain struct {
+	routes []parentRoute
+	cidr   bool // 是否包含 CIDR 规则，决定是否需要解析域名
+}
+
+// ConfigParentProxy 替换上级代理规则，按顺序匹配目标，第一个命中的生效，都不命中时直连。
+// 解密后的请求和不解密的隧道都经过上级代理，运行中调用立即生效
+func (s *Server) ConfigParentProxy(parents []ParentProxy) error {
+	chain := &parentChain{}
+	for _, parent := range parents {
+		route := parentRoute{}
+		if !strings.EqualFold(parent.URL, ParentDirect) {
+			u, err := url.Parse(parent.URL)
+			if err != nil {
+				return fmt.Errorf("invalid parent proxy %q: %w", parent.URL, err)
+			}
+			switch u.Scheme {
+			case "http", "https", "socks5", "socks5h":
+			default:
+				return fmt.Errorf("unsupported parent proxy %q", parent.URL)
+			}
+			if u.Port() == "" {
+				u.Host = net.JoinHostPort(u.Hostname(), defaultParentPort(u.Scheme))
+			}
+			route.url = u
+		}
+		for _, raw := range parent.Hosts {
+			rule, err := parseHostRule(raw)
+			if err != nil {
+				return err
+			}
+			if rule.ipNet != nil {
+				chain.cidr = true
+			}
+			route.rules = append(route.rules, rule)
+		}
+		chain.routes = append(chain.routes, route)
+	}
+	s.parents.Store(chain)
+	// 已有的上游连接可能走的是旧规则
+	s.upstream.Load().closeIdleConnections()
+	return nil
+}
+
+func defaultParentPort(scheme string) string {
+	switch scheme {
+	case "https":
+		return "443"
+	case "socks5", "socks5h":
+		return "1080"
+	default:
+		return "80"
+	}
+}
+
+// parentFor 返回目标（host:port）使用的上级代理，nil 表示直连
+func (s *Server) parentFor(addr string) *url.URL {
+	chain := s.parents.Load()
+	if chain == nil {
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = normalizeHost(host)
+	port, _ := strconv.Atoi(portStr)
+	ips := ruleIPs(host, chain.cidr)
+	for _, route := range chain.routes {
+		if len(route.rules) == 0 || matchRules(route.rules, host, ips, port) {
+			return route.url
+		}
+	}
+	return nil
+}
+
+// parentProxyURL 上游连接池的 Proxy 函数：解密后的请求由 http.Transport 通过上级代理转发
+func (s *Server) parentProxyURL(req *http.Request) (*url.URL, error) {
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+	return s.parentFor(host), nil
+}
+
+// dialParent 通过上级代理连接目标，用于不解密的隧道
+func (s *Server) dialParent(ctx context.Context, parent *url.URL, network, addr string) (net.Conn, error) {
+	if parent.Scheme == "socks5" || parent.Scheme == "socks5h" {
+		var auth *proxy.Auth
+		if parent.User != nil {
+			password, _ := parent.User.Password()
+			auth = &proxy.Auth{User: parent.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", parent.Host, auth, directDialer{s})
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	}
+
+	conn, err := s.dialDirect(ctx, "tcp", parent.Host)
+	if err != nil {
+		return nil, err
+	}
+	if parent.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         parent.Hostname(),
+			InsecureSkipVerify: s.upstream.Load().config.InsecureSkipVerify,
+		})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer clearDeadline(conn)
+	}
+
+	request := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if parent.User != nil {
+		password, _ := parent.User.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(parent.User.Username() + ":" + password))
+		request += "Proxy-Authorization: Basic " + credential + "\r\n"
+	}
+	if _, err = conn.Write([]byte(request + "\r\n")); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("parent proxy %s: CONNECT %s: %s", parent.Host, addr, response.Status)
+	}
+	if reader.Buffered() > 0 {
+		// 上级代理在响应之后已经转发了目标的数据
+		return &util.BufferedConn{Conn: conn, Reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// directDialer 让 SOCKS5 客户端使用代理自己的直连拨号
+type directDialer struct {
+	s *Server
+}
+
+func (d directDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.s.dialDirect(context.Background(), network, addr)
+}
+
+func (d directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.s.dialDirect(ctx, network, addr)
+}
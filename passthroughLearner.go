@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PassthroughEntry 某个主机的 TLS 握手失败记录
+type PassthroughEntry struct {
+	Host        string    `json:"host"`
+	Failures    int       `json:"failures"`
+	Clients     []string  `json:"clients"` // 握手失败的客户端 IP
+	LastError   string    `json:"lastError"`
+	LastFailure time.Time `json:"lastFailure"`
+	Passthrough bool      `json:"passthrough"` // 已自动切换为直接转发
+}
+
+// passthroughLearner 记录客户端拒绝生成证书的情况（通常是证书固定），失败次数达到阈值后该主机不再解密
+type passthroughLearner struct {
+	lock      sync.Mutex
+	threshold int
+	entries   map[string]*PassthroughEntry
+}
+
+func newPassthroughLearner() *passthroughLearner {
+	return &passthroughLearner{
+		entries: map[string]*PassthroughEntry{},
+	}
+}
+
+// ConfigPassthroughLearning 客户端拒绝生成证书 threshold 次后该主机自动改为直接转发，0 表示关闭
+func (s *Server) ConfigPassthroughLearning(threshold int) {
+	s.learner.lock.Lock()
+	defer s.learner.lock.Unlock()
+	s.learner.threshold = threshold
+}
+
+// PassthroughEntries 返回握手失败记录，按主机排序；Passthrough 为 true 的即已学习的直接转发列表
+func (s *Server) PassthroughEntries() []PassthroughEntry {
+	s.learner.lock.Lock()
+	defer s.learner.lock.Unlock()
+	entries := make([]PassthroughEntry, 0, len(s.learner.entries))
+	for _, entry := range s.learner.entries {
+		copied := *entry
+		copied.Clients = append([]string(nil), entry.Clients...)
+		entries = append(entries, copied)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Host < entries[j].Host
+	})
+	return entries
+}
+
+// LoadPassthrough 恢复之前持久化的直接转发主机
+func (s *Server) LoadPassthrough(hosts []string) {
+	s.learner.lock.Lock()
+	defer s.learner.lock.Unlock()
+	for _, host := range hosts {
+		host = normalizeHost(host)
+		entry := s.learner.entry(host)
+		entry.Passthrough = true
+	}
+}
+
+// ForgetPassthrough 清除主机的失败记录，恢复解密
+func (s *Server) ForgetPassthrough(host string) {
+	s.learner.lock.Lock()
+	defer s.learner.lock.Unlock()
+	delete(s.learner.entries, normalizeHost(host))
+}
+
+// recordHandshakeFailure 记录一次客户端握手失败，host 可以带端口
+func (l *passthroughLearner) recordHandshakeFailure(host, client string, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.threshold <= 0 {
+		return
+	}
+	entry := l.entry(normalizeHost(host))
+	entry.Failures++
+	entry.LastError = err.Error()
+	entry.LastFailure = time.Now()
+	found := false
+	for _, c := range entry.Clients {
+		if c == client {
+			found = true
+			break
+		}
+	}
+	if !found {
+		entry.Clients = append(entry.Clients, client)
+	}
+	if !entry.Passthrough && entry.Failures >= l.threshold {
+		entry.Passthrough = true
+		log.Printf("%s 握手失败 %d 次，切换为直接转发", entry.Host, entry.Failures)
+	}
+}
+
+// rejectedCertificate 握手错误是否为客户端发来的证书相关 alert，例如 bad_certificate、unknown_ca。
+// 客户端直接断开、超时等错误不代表拒绝证书，不计入失败次数
+func rejectedCertificate(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+	// crypto/tls 的 alert 类型未导出，按描述判断
+	switch strings.TrimPrefix(opErr.Err.Error(), "tls: ") {
+	case "bad certificate", "unsupported certificate", "revoked certificate",
+		"expired certificate", "unknown certificate", "unknown certificate authority":
+		return true
+	}
+	return false
+}
+
+// closedBeforeRequest 握手成功后的首次读取错误是否为客户端主动断开。证书固定的客户端（如 OkHttp）
+// 握手完成后才校验证书，不匹配时直接关闭连接而不发送 alert；超时不计入
+func closedBeforeRequest(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// passthrough 主机是否已学习为直接转发
+func (l *passthroughLearner) passthrough(host string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry, ok := l.entries[normalizeHost(host)]
+	return ok && entry.Passthrough
+}
+
+func (l *passthroughLearner) entry(host string) *PassthroughEntry {
+	entry, ok := l.entries[host]
+	if !ok {
+		entry = &PassthroughEntry{Host: host}
+		l.entries[host] = entry
+	}
+	return entry
+}
+
+// normalizeHost 去掉端口和末尾的点并转小写
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+	"github.com/xyjwsj/request-proxy/util"
+	"golang.org/x/net/http2"
+)
+
+// DetectResult 协议识别结果
+type DetectResult int
+
+const (
+	DetectNo   DetectResult = iota // 不是该协议
+	DetectYes                      // 认领连接
+	DetectMore                     // 已有字节不足以判断，需要更多
+)
+
+// maxDetectPrefix 识别协议时最多预读的字节数，超过后仍要求更多字节的识别器视为不匹配
+const maxDetectPrefix = 64
+
+// ProtocolDetector 协议识别器：Detect 检查连接开头已读到的字节（不会被消费），
+// 认领后由 Handle 处理连接，wrapReq.Reader 中仍包含这些字节。Handle 返回后连接关闭
+type ProtocolDetector struct {
+	Name   string
+	Detect func(prefix []byte) DetectResult
+	Handle func(wrapReq model.WrapRequest)
+}
+
+// RegisterProtocol 注册自定义协议，按注册顺序在内置协议（PROXY protocol、HTTP/2 前言、HTTP/1.x、TLS、SOCKS4/5）之前识别，
+// SOCKS 隧道建立后客户端发送的数据同样先经过这些识别器。Handle 运行期间连接按处理中的请求参与停机排空
+func (s *Server) RegisterProtocol(detector ProtocolDetector) error {
+	if detector.Name == "" || detector.Detect == nil || detector.Handle == nil {
+		return errors.New("protocol detector requires Name, Detect and Handle")
+	}
+	// Handle 运行期间连接视为处理中：停机时等待它返回，超时后强制关闭
+	handle := detector.Handle
+	detector.Handle = func(wrapReq model.WrapRequest) {
+		s.setConnState(wrapReq, stateActive)
+		handle(wrapReq)
+	}
+	s.config.protocols = append(s.config.protocols, detector)
+	return nil
+}
+
+// builtinProtocols 内置协议，顺序决定优先级
+func (s *Server) builtinProtocols() []ProtocolDetector {
+	return []ProtocolDetector{
+		{Name: "proxy-protocol", Detect: detectProxyProtocol, Handle: func(wrapReq model.WrapRequest) {
+			// 可信来源的头部在识别前已经解析，到这里说明来源不可信
+			log.Printf("拒绝来自 %s 的 PROXY protocol 头部：来源不可信", wrapReq.Conn.RemoteAddr())
+		}},
+		{Name: "http2", Detect: detectHTTP2Preface, Handle: s.handleHTTP2Preface},
+		{Name: "http", Detect: detectHTTP, Handle: s.handleHTTP},
+		{Name: "tls", Detect: detectTLS, Handle: func(wrapReq model.WrapRequest) {
+			s.handleTLS(wrapReq, "")
+		}},
+		{Name: "socks4", Detect: detectFirstByte(0x4), Handle: s.handleSocks4},
+		{Name: "socks5", Detect: detectFirstByte(0x5), Handle: s.handleSocks5},
+	}
+}
+
+// detect 按顺序询问识别器，排在前面的识别器需要更多字节时先继续预读，保证优先级。
+// 没有识别器认领时返回 nil
+func detect(reader *bufio.Reader, lists ...[]ProtocolDetector) *ProtocolDetector {
+	n := 1
+	for {
+		_, err := reader.Peek(n)
+		prefix, _ := reader.Peek(reader.Buffered())
+		if len(prefix) == 0 {
+			return nil
+		}
+		// 读不到更多字节或已达上限时，需要更多字节的识别器视为不匹配
+		final := err != nil || len(prefix) >= maxDetectPrefix
+		if len(prefix) > maxDetectPrefix {
+			prefix = prefix[:maxDetectPrefix]
+		}
+
+		more := false
+	scan:
+		for _, list := range lists {
+			for i := range list {
+				switch list[i].Detect(prefix) {
+				case DetectYes:
+					return &list[i]
+				case DetectMore:
+					if !final {
+						more = true
+						break scan
+					}
+				}
+			}
+		}
+		if !more {
+			return nil
+		}
+		n = len(prefix) + 1
+	}
+}
+
+// detectWithin 与 detect 相同，但最多等待客户端 sniffTimeout：服务端先发言的协议（如 SMTP、MySQL）客户端不会先发送数据，
+// 超时后需要更多字节的识别器视为不匹配。已读到的字节仍保留在 Reader 中
+func detectWithin(wrapReq model.WrapRequest, lists ...[]ProtocolDetector) *ProtocolDetector {
+	_ = wrapReq.Conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer clearDeadline(wrapReq.Conn)
+	return detect(wrapReq.Reader, lists...)
+}
+
+// detectFirstByte 首字节等于 b 的协议
+func detectFirstByte(b byte) func([]byte) DetectResult {
+	return func(prefix []byte) DetectResult {
+		if prefix[0] == b {
+			return DetectYes
+		}
+		return DetectNo
+	}
+}
+
+// detectLiteral prefix 以 literal 开头时认领，是 literal 的前缀时需要更多字节
+func detectLiteral(prefix []byte, literal string) DetectResult {
+	if len(prefix) >= len(literal) {
+		if string(prefix[:len(literal)]) == literal {
+			return DetectYes
+		}
+		return DetectNo
+	}
+	if string(prefix) == literal[:len(prefix)] {
+		return DetectMore
+	}
+	return DetectNo
+}
+
+func detectProxyProtocol(prefix []byte) DetectResult {
+	if result := detectLiteral(prefix, "PROXY "); result != DetectNo {
+		return result
+	}
+	return detectLiteral(prefix, string(proxyV2Signature))
+}
+
+func detectHTTP2Preface(prefix []byte) DetectResult {
+	return detectLiteral(prefix, http2.ClientPreface)
+}
+
+// detectHTTP 请求行以方法 token 加空格开头即认领，方法不限于常见的几种（例如 PATCH、PROPFIND）
+func detectHTTP(prefix []byte) DetectResult {
+	for i, b := range prefix {
+		switch {
+		case b == ' ':
+			if i == 0 {
+				return DetectNo
+			}
+			return DetectYes
+		case b >= 'A' && b <= 'Z', b == '-', b == '_':
+		default:
+			return DetectNo
+		}
+		if i >= 24 {
+			return DetectNo
+		}
+	}
+	return DetectMore
+}
+
+// detectTLS TLS 握手记录：类型 0x16，主版本 3
+func detectTLS(prefix []byte) DetectResult {
+	if prefix[0] != recordTypeHandshake {
+		return DetectNo
+	}
+	if len(prefix) < 2 {
+		return DetectMore
+	}
+	if prefix[1] == 0x03 {
+		return DetectYes
+	}
+	return DetectNo
+}
+
+// handleHTTP2Preface 以 HTTP/2 前言开头的明文连接（h2c prior knowledge），开启 ConfigH2C 时按 HTTP/2 拦截
+func (s *Server) handleHTTP2Preface(wrapReq model.WrapRequest) {
+	if !s.config.h2c {
+		log.Printf("拒绝来自 %s 的 h2c 连接：未开启 ConfigH2C", wrapReq.Conn.RemoteAddr())
+		return
+	}
+	s.serveHTTP2(wrapReq, &util.BufferedConn{Conn: wrapReq.Conn, Reader: wrapReq.Reader}, nil)
+}
@@ -2,82 +2,138 @@ package proxy
 
 import (
 	"bufio"
-	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/xyjwsj/request-proxy/model"
 	"github.com/xyjwsj/request-proxy/util"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 type ConfigProxy struct {
 	requestCall  model.RequestCall
 	responseCall model.ResponseCall
 	https        bool
+	certificate  *util.Certificate
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	streaming    bool
+	bufferCall   model.BufferCall
+	http2        bool
+	h2c          bool
+	// 流式响应
+	streamChunked bool
+	eventCall     model.EventCall
+	// 隧道
+	tunnelCall model.TunnelCall
+	// WebSocket
+	webSocketCall model.WebSocketCall
+	// gRPC
+	grpcCall  model.GrpcCall
+	grpcFiles *protoregistry.Files
+	// 透明 TLS
+	sniPort int
+	// 透明代理
+	transparent string
+	// 自定义协议
+	protocols []ProtocolDetector
+	// SOCKS
+	socksAuth      model.AuthCall
+	udpIdleTimeout time.Duration
+	datagramCall   model.DatagramCall
 }
 
-var config *ConfigProxy
+// defaultServer 包级函数使用的默认实例，兼容 ConfigXxx/HandleClient 的调用方式
+var defaultServer = newDefaultServer()
 
-func init() {
-	config = &ConfigProxy{
-		requestCall:  nil,
-		responseCall: nil,
-		https:        false,
-	}
+func newDefaultServer() *Server {
+	server := NewServer(DefaultAddr)
+	server.cache = Cache
+	return server
 }
 
 func ConfigHttps(https bool) {
-	config.https = https
+	defaultServer.ConfigHttps(https)
 }
 
 func ConfigOnRequest(onRequest model.RequestCall) {
-	config.requestCall = onRequest
+	defaultServer.ConfigOnRequest(onRequest)
 }
 
 func ConfigOnResponse(onResponse model.ResponseCall) {
-	config.responseCall = onResponse
+	defaultServer.ConfigOnResponse(onResponse)
 }
 
 // HandleClient 处理客户端连接
 func HandleClient(clientConn net.Conn) {
+	defaultServer.ServeConn(clientConn)
+}
+
+// serveConn 识别协议并分发客户端连接
+func (s *Server) serveConn(clientConn net.Conn) {
 	defer clientConn.Close()
 
 	reader := bufio.NewReader(clientConn)
-	writer := bufio.NewWriter(clientConn)
 
-	peek, err := reader.Peek(1)
-	if err != nil {
-		return
+	s.readDeadline(clientConn)
+	conn := clientConn
+	if s.trustsProxyProtocol(clientConn) {
+		src, dst, err := readProxyHeader(reader)
+		if err != nil {
+			log.Printf("PROXY protocol from %s: %v", clientConn.RemoteAddr(), err)
+			return
+		}
+		if src != nil {
+			conn = &proxiedConn{Conn: clientConn, remote: src, local: dst}
+		}
+	}
+	target := ""
+	if s.config.transparent != "" {
+		target = s.originalTarget(clientConn)
+	}
+	// 透明代理的连接可能是服务端先发言的协议，不能等待客户端的首字节
+	if target == "" {
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
 	}
-
-	peekHex := fmt.Sprintf("0x%x", peek[0])
 
 	request := model.WrapRequest{
-		ID:     util.UUID(),
-		Conn:   clientConn,
-		Reader: reader,
-		Writer: writer,
+		ID:          util.UUID(),
+		RawConn:     clientConn,
+		Conn:        conn,
+		Reader:      reader,
+		Writer:      bufio.NewWriter(conn),
+		Target:      target,
+		Source:      conn.RemoteAddr(),
+		Destination: conn.LocalAddr(),
 	}
 
-	if config != nil {
-		if config.requestCall != nil {
-			request.OnRequest = config.requestCall
+	if s.config != nil {
+		if s.config.requestCall != nil {
+			request.OnRequest = s.config.requestCall
 		}
-		if config.responseCall != nil {
-			request.OnResponse = config.responseCall
+		if s.config.responseCall != nil {
+			request.OnResponse = s.config.responseCall
 		}
-		request.Https = config.https
+		request.Https = s.config.https
+	}
+
+	if request.Target != "" {
+		s.handleTransparent(request)
+		return
+	}
+	if s.reverse.Load() != nil {
+		// 反向代理模式下客户端直接发送 HTTP 请求
+		s.handleHTTP(request)
+		return
 	}
 
-	switch peekHex {
-	case "0x47", "0x43", "0x50", "0x4f", "0x44", "0x48":
-		HandleHTTP(request)
-		break
-	case "0x5":
-		// TODO socket
-		log.Println("xxxxx")
-	default:
-		// TODO TCP
-		HandleTCP(request)
+	if protocol := detect(reader, s.config.protocols, s.builtins); protocol != nil {
+		protocol.Handle(request)
+		return
 	}
+	s.handleTCP(request)
 }
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature PROXY protocol v2 头部的固定签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength v1 头部（含 CRLF）的最大长度
+const proxyV1MaxLength = 107
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// ConfigProxyProtocol 信任来自 trusted（CIDR 或单个 IP）的连接开头的 PROXY protocol v1/v2 头部，
+// 之后 ClientIp 等使用头部中的真实源地址。其它来源的连接不解析头部；trusted 为空时关闭。运行中调用对新连接立即生效
+func (s *Server) ConfigProxyProtocol(trusted []string) error {
+	var nets []*net.IPNet
+	for _, raw := range trusted {
+		value := strings.TrimSpace(raw)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return fmt.Errorf("invalid PROXY protocol source %q", raw)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("invalid PROXY protocol source %q: %w", raw, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	if len(nets) == 0 {
+		s.trusted.Store(nil)
+		return nil
+	}
+	s.trusted.Store(&nets)
+	return nil
+}
+
+// trustsProxyProtocol 连接是否来自可信的 PROXY protocol 来源
+func (s *Server) trustsProxyProtocol(conn net.Conn) bool {
+	nets := s.trusted.Load()
+	if nets == nil {
+		return false
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range *nets {
+		if ipNet.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxiedConn 经 PROXY protocol 传递地址的连接，RemoteAddr 和 LocalAddr 返回头部中的地址
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remote }
+func (c *proxiedConn) LocalAddr() net.Addr  { return c.local }
+
+// CloseWrite 半关闭底层连接，隧道转发依赖它
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader 读取连接开头的 PROXY protocol 头部。没有头部、头部为 LOCAL/UNKNOWN
+// 或地址族不是 TCP 时返回 nil 地址，连接按原地址处理
+func readProxyHeader(reader *bufio.Reader) (src, dst net.Addr, err error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if prefix, err := reader.Peek(6); err != nil || string(prefix) != "PROXY " {
+			// 以 P 开头的 HTTP 请求
+			return nil, nil, nil
+		}
+		return readProxyV1(reader)
+	case '\r':
+		if signature, err := reader.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(signature, proxyV2Signature) {
+			return nil, nil, nil
+		}
+		return readProxyV2(reader)
+	}
+	return nil, nil, nil
+}
+
+// readProxyV1 解析文本格式：PROXY TCP4 src dst sport dport\r\n
+func readProxyV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 解析二进制格式：签名、版本/命令、地址族、长度，之后为地址和 TLV（TLV 忽略）
+func readProxyV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, err
+	}
+	if header[12]&0x0f == 0 {
+		// LOCAL：负载均衡器自己发起的连接，例如健康检查
+		return nil, nil, nil
+	}
+	if header[12]&0x0f != 1 {
+		return nil, nil, errProxyHeader
+	}
+
+	var ipLen int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errProxyHeader
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,385 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+	"github.com/xyjwsj/request-proxy/util"
+)
+
+const (
+	DefaultAddr          = ":8080"
+	DefaultIdleTimeout   = 60 * time.Second
+	shutdownPollInterval = 50 * time.Millisecond
+	// newConnGrace 停机时刚接收、尚未发送请求的连接保留的时间，超过后按空闲连接关闭
+	newConnGrace = time.Second
+)
+
+// ErrServerClosed Shutdown 之后调用 Serve/ListenAndServe 返回的错误
+var ErrServerClosed = errors.New("proxy: Server closed")
+
+// connState 客户端连接当前所处阶段
+type connState int32
+
+const (
+	stateNew    connState = iota // 已接收，尚未读到请求
+	stateActive                  // 正在处理请求
+	stateIdle                    // 请求处理完成，等待下一个请求
+	stateTunnel                  // 已进入隧道转发
+)
+
+// trackedConn 记录连接状态，用于停机时区分空闲连接和处理中的连接
+type trackedConn struct {
+	net.Conn
+	state    atomic.Int32
+	accepted time.Time
+}
+
+func (c *trackedConn) getState() connState {
+	return connState(c.state.Load())
+}
+
+// CloseWrite 转发半关闭，隧道一端结束时通知另一端
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// ShutdownReport 停机结果：Drained 为正常结束的连接数，Aborted 为超时后被强制关闭的连接数
+type ShutdownReport struct {
+	Drained int
+	Aborted int
+}
+
+// Server 代理服务实例，每个实例持有独立的配置、证书缓存和连接
+type Server struct {
+	Addr string
+
+	config   *ConfigProxy
+	cache    *Storage
+	upstream atomic.Pointer[upstreamTransport]
+	policy   atomic.Pointer[interceptPolicy]
+	parents  atomic.Pointer[parentChain]
+	reverse  atomic.Pointer[reverseTarget]
+	trusted  atomic.Pointer[[]*net.IPNet]             // PROXY protocol 可信来源
+	streams  atomic.Pointer[map[int]model.StreamCall] // 目标端口 -> 字节流钩子，0 匹配所有端口
+	learner  *passthroughLearner
+	builtins []ProtocolDetector
+	sockets  sync.Map // 握手请求 ID -> *wsSession
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*trackedConn]struct{}
+	inShutdown atomic.Bool
+}
+
+// NewServer 创建代理服务，addr 为空时监听 DefaultAddr
+func NewServer(addr string) *Server {
+	server := &Server{
+		Addr: addr,
+		config: &ConfigProxy{
+			requestCall:  nil,
+			responseCall: nil,
+			https:        false,
+			idleTimeout:  DefaultIdleTimeout,
+		},
+		cache:     NewStorage(),
+		learner:   newPassthroughLearner(),
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[*trackedConn]struct{}{},
+	}
+	server.upstream.Store(server.newUpstreamTransport(DefaultTransportConfig()))
+	server.builtins = server.builtinProtocols()
+	return server
+}
+
+func (s *Server) ConfigHttps(https bool) {
+	s.config.https = https
+}
+
+func (s *Server) ConfigOnRequest(onRequest model.RequestCall) {
+	s.config.requestCall = onRequest
+}
+
+func (s *Server) ConfigOnResponse(onResponse model.ResponseCall) {
+	s.config.responseCall = onResponse
+}
+
+// ConfigCertificate 使用独立的根证书签发子证书，同时重建证书缓存
+func (s *Server) ConfigCertificate(certificate *util.Certificate) {
+	s.config.certificate = certificate
+	s.cache = NewStorageWithCertificate(certificate)
+}
+
+// ConfigTimeout 配置读取请求头和写回响应的超时时间，0 表示不限制
+func (s *Server) ConfigTimeout(read, write time.Duration) {
+	s.config.readTimeout = read
+	s.config.writeTimeout = write
+}
+
+// ConfigIdleTimeout 配置保持连接等待下一个请求的最长时间，0 表示不限制
+func (s *Server) ConfigIdleTimeout(idle time.Duration) {
+	s.config.idleTimeout = idle
+}
+
+// rootCertificate 当前实例使用的根证书
+func (s *Server) rootCertificate() *util.Certificate {
+	if s.config.certificate != nil {
+		return s.config.certificate
+	}
+	return util.Cert
+}
+
+// ListenAndServe 监听 Addr 并处理客户端连接
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve 在指定 listener 上接收连接，直到 listener 关闭或调用 Shutdown
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		_ = ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// 临时错误退避重试
+			if tempDelay == 0 {
+				tempDelay = 5 * time.Millisecond
+			} else {
+				tempDelay *= 2
+			}
+			if tempDelay > time.Second {
+				tempDelay = time.Second
+			}
+			log.Println("Accept Error:" + err.Error())
+			time.Sleep(tempDelay)
+			continue
+		}
+		tempDelay = 0
+
+		tc := s.trackConn(conn)
+		if tc == nil {
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			defer s.untrackConn(tc)
+			s.serveConn(tc)
+		}()
+	}
+}
+
+// ServeConn 处理单个已建立的客户端连接，处理完成后关闭连接
+func (s *Server) ServeConn(conn net.Conn) {
+	tc := s.trackConn(conn)
+	if tc == nil {
+		_ = conn.Close()
+		return
+	}
+	defer s.untrackConn(tc)
+	s.serveConn(tc)
+}
+
+// Shutdown 停止接收新连接，等待已有连接处理完成；ctx 结束时强制关闭剩余连接
+func (s *Server) Shutdown(ctx context.Context) error {
+	_, err := s.ShutdownWithReport(ctx)
+	return err
+}
+
+// ShutdownWithReport 与 Shutdown 相同，额外返回排空和强制中断的连接数。
+// 空闲连接立即关闭，处理中的请求和隧道在 ctx 结束前允许继续，之后被强制关闭
+func (s *Server) ShutdownWithReport(ctx context.Context) (ShutdownReport, error) {
+	s.inShutdown.Store(true)
+	err := s.closeListeners()
+	total := s.connCount()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.closeIdleConns()
+		if s.connCount() == 0 {
+			s.closeUpstream()
+			return ShutdownReport{Drained: total}, err
+		}
+		select {
+		case <-ctx.Done():
+			aborted := s.closeConns()
+			s.closeUpstream()
+			if aborted > total {
+				total = aborted
+			}
+			log.Printf("Shutdown: drained %d, aborted %d", total-aborted, aborted)
+			return ShutdownReport{Drained: total - aborted, Aborted: aborted}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// InFlight 当前正在处理请求或转发隧道的连接数
+func (s *Server) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for tc := range s.conns {
+		if state := tc.getState(); state == stateActive || state == stateTunnel {
+			count++
+		}
+	}
+	return count
+}
+
+// Close 立即关闭所有 listener 和连接
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+	err := s.closeListeners()
+	s.closeConns()
+	s.closeUpstream()
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+// trackConn 登记新连接，停机中返回 nil
+func (s *Server) trackConn(conn net.Conn) *trackedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return nil
+	}
+	tc := &trackedConn{Conn: conn, accepted: time.Now()}
+	s.conns[tc] = struct{}{}
+	return tc
+}
+
+func (s *Server) untrackConn(tc *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, tc)
+}
+
+// setConnState 更新连接阶段，wrapReq.RawConn 不是本实例登记的连接时忽略
+func (s *Server) setConnState(wrapReq model.WrapRequest, state connState) {
+	if tc, ok := wrapReq.RawConn.(*trackedConn); ok {
+		tc.state.Store(int32(state))
+	}
+}
+
+func (s *Server) connCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeConns 强制关闭所有连接，返回关闭数量
+func (s *Server) closeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tc := range s.conns {
+		_ = tc.Close()
+	}
+	return len(s.conns)
+}
+
+// closeIdleConns 关闭等待下一个请求的空闲连接，以及接收后超过 newConnGrace 仍未发送请求的连接（例如浏览器预连接）
+func (s *Server) closeIdleConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tc := range s.conns {
+		switch tc.getState() {
+		case stateIdle:
+			_ = tc.Close()
+		case stateNew:
+			if time.Since(tc.accepted) >= newConnGrace {
+				_ = tc.Close()
+			}
+		}
+	}
+}
+
+// readDeadline 读取请求前设置读超时
+func (s *Server) readDeadline(conn net.Conn) {
+	if s.config.readTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(s.config.readTimeout))
+	} else {
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// idleDeadline 等待下一个请求前设置空闲超时
+func (s *Server) idleDeadline(conn net.Conn) {
+	if s.config.idleTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(s.config.idleTimeout))
+	} else {
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// writeDeadline 写回响应前设置写超时
+func (s *Server) writeDeadline(conn net.Conn) {
+	if s.config.writeTimeout > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(s.config.writeTimeout))
+	}
+}
+
+// clearDeadline 清除连接上的超时，隧道转发阶段不受限制
+func clearDeadline(conn net.Conn) {
+	_ = conn.SetDeadline(time.Time{})
+}
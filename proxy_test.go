@@ -1,46 +1,137 @@
 package proxy
 
 import (
-	"github.com/xyjwsj/request-proxy/model"
-	"github.com/xyjwsj/request-proxy/util"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+	"github.com/xyjwsj/request-proxy/util"
+	"golang.org/x/net/http2"
 )
 
 func TestRequest(t *testing.T) {
-	certificate := util.NewCertificate()
-	certificate.Init()
-	ln, _ := net.Listen("tcp", ":8080")
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println("Accept Error:" + err.Error())
-			continue
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello " + r.URL.Query().Get("name")))
+	}))
+	defer origin.Close()
+
+	var requested, responded atomic.Bool
+	server := NewServer("127.0.0.1:0")
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		log.Println("请求数据:", data)
+		requested.Store(true)
+		return model.RequestData{
+			Header: nil,
+			Query:  nil,
+			Body:   "",
+		}
+	})
+	server.ConfigOnResponse(func(data model.ResponseData) model.ResponseData {
+		log.Println("响应数据:", data)
+		responded.Store(true)
+		return model.ResponseData{
+			Code:   -1,
+			Header: nil,
+			Body:   "",
 		}
+	})
+	_, client, shutdown := startProxy(t, server)
+	defer shutdown()
 
-		go func() {
-			ConfigHttps(true)
-			ConfigOnRequest(func(data model.RequestData) model.RequestData {
-				log.Println("请求数据:", data)
-				return model.RequestData{
-					Header: nil,
-					Query:  nil,
-					Body:   "",
-				}
-			})
-			ConfigOnResponse(func(data model.ResponseData) model.ResponseData {
-				log.Println("响应数据:", data)
-				return model.ResponseData{
-					Code:   -1,
-					Header: nil,
-					Body:   "",
-				}
-			})
-			HandleClient(conn)
-		}()
+	resp, err := client.Get(origin.URL + "?name=proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "hello proxy" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if !requested.Load() || !responded.Load() {
+		t.Fatal("hooks not called")
+	}
+}
+
+// startProxy 在随机端口启动代理，返回代理地址、走该代理的 client 和关闭函数
+func startProxy(t *testing.T, server *Server) (string, *http.Client, func()) {
+	return serveProxy(t, server, listenLocal(t))
+}
+
+// serveProxy 在 ln 上启动代理，用于需要包装监听的测试
+func serveProxy(t *testing.T, server *Server, ln net.Listener) (string, *http.Client, func()) {
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ln)
+	}()
+	proxyURL, _ := url.Parse("http://" + ln.Addr().String())
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+	return ln.Addr().String(), client, func() {
+		client.CloseIdleConnections()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v", err)
+		}
+	}
+}
 
+// listenLocal 在 127.0.0.1 的随机端口监听，失败时结束测试
+func listenLocal(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+func TestTwoServers(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	newServer := func(body string) *Server {
+		server := NewServer("")
+		server.ConfigOnResponse(func(data model.ResponseData) model.ResponseData {
+			return model.ResponseData{Code: -1, Body: body}
+		})
+		return server
+	}
+	_, clientA, shutdownA := startProxy(t, newServer("a"))
+	defer shutdownA()
+	_, clientB, shutdownB := startProxy(t, newServer("b"))
+	defer shutdownB()
+
+	for client, want := range map[*http.Client]string{clientA: "a", clientB: "b"} {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != want {
+			t.Fatalf("want %q, got %q", want, body)
+		}
 	}
 }
 
@@ -53,3 +144,1403 @@ func TestDomainIp(t *testing.T) {
 	domain, _ := util.GetIPFromDomain("platform.hoolai.com")
 	log.Println(domain)
 }
+
+func TestShutdownDrain(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		} else {
+			<-release
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	for _, c := range []struct {
+		path    string
+		timeout time.Duration
+		want    ShutdownReport
+	}{
+		{"/slow", 2 * time.Second, ShutdownReport{Drained: 1}},
+		{"/block", 200 * time.Millisecond, ShutdownReport{Aborted: 1}},
+		// 预连接：连上后不发送请求，宽限期后按空闲连接关闭
+		{"", 3 * time.Second, ShutdownReport{Drained: 1}},
+		// 自定义协议处理中的连接超过宽限期也不会被当作预连接关闭
+		{"hold", 1500 * time.Millisecond, ShutdownReport{Aborted: 1}},
+	} {
+		server := NewServer("")
+		_ = server.RegisterProtocol(ProtocolDetector{
+			Name: "hold",
+			Detect: func(prefix []byte) DetectResult {
+				return detectLiteral(prefix, "HOLD")
+			},
+			Handle: func(wrapReq model.WrapRequest) {
+				_, _ = io.WriteString(wrapReq.Conn, "held\n")
+				// 一直处理到连接关闭
+				_, _ = io.Copy(io.Discard, wrapReq.Reader)
+			},
+		})
+		proxyAddr, client, shutdown := startProxy(t, server)
+		defer shutdown()
+
+		if c.path == "hold" {
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, _ = io.WriteString(conn, "HOLD\n")
+			if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "held\n" {
+				t.Fatalf("unexpected reply %q, %v", line, err)
+			}
+		} else if c.path == "" {
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for server.connCount() == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		} else {
+			go client.Get(origin.URL + c.path)
+			for server.InFlight() == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		report, _ := server.ShutdownWithReport(ctx)
+		cancel()
+		if report != c.want {
+			t.Fatalf("%s: want %+v, got %+v", c.path, c.want, report)
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+
+	var ids sync.Map
+	server := NewServer("")
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		ids.Store(data.ID, data.Url)
+		return model.RequestData{}
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for i, c := range []struct {
+		path  string
+		proto string
+		extra string
+		close bool
+	}{
+		{"/one", "HTTP/1.1", "", false},
+		{"/two", "HTTP/1.0", "Connection: keep-alive\r\n", false},
+		{"/three", "HTTP/1.1", "Connection: close\r\n", true},
+	} {
+		_, _ = fmt.Fprintf(conn, "GET %s%s %s\r\nHost: %s\r\n%s\r\n", origin.URL, c.path, c.proto, origin.Listener.Addr(), c.extra)
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != c.path || resp.Close != c.close {
+			t.Fatalf("request %d: body %q close %v", i, body, resp.Close)
+		}
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("connection should be closed, got %v", err)
+	}
+	count := 0
+	ids.Range(func(key, value any) bool {
+		count++
+		return true
+	})
+	if count != 3 {
+		t.Fatalf("want 3 request ids, got %d", count)
+	}
+}
+
+// newTestCertificate 在临时目录生成根证书，避免污染工作目录
+func newTestCertificate(t *testing.T) *util.Certificate {
+	certificate := util.NewCertificateWithPath(t.TempDir())
+	if err := certificate.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// countListener 统计 Accept 次数
+type countListener struct {
+	net.Listener
+	count atomic.Int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.count.Add(1)
+	}
+	return conn, err
+}
+
+func TestMitmTunnelRequests(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.URL.Path + ":" + string(body)))
+	}))
+	defer origin.Close()
+
+	certificate := newTestCertificate(t)
+	var hooks atomic.Int32
+	server := NewServer("")
+	server.ConfigCertificate(certificate)
+	server.ConfigHttps(true)
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		hooks.Add(1)
+		if data.Protocol != "https" {
+			t.Errorf("unexpected protocol %s", data.Protocol)
+		}
+		return model.RequestData{Body: "rewritten"}
+	})
+	counted := &countListener{Listener: listenLocal(t)}
+	proxyAddr, _, shutdown := serveProxy(t, server, counted)
+	defer shutdown()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.RootCa)
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, err := client.Post(origin.URL+path, "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != path+":rewritten" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+	if hooks.Load() != 3 {
+		t.Fatalf("want 3 hook calls, got %d", hooks.Load())
+	}
+	if counted.count.Load() != 1 {
+		t.Fatalf("want 1 tunnel, got %d", counted.count.Load())
+	}
+}
+
+func TestTransportPool(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	certificate := newTestCertificate(t)
+	server := NewServer("")
+	server.ConfigCertificate(certificate)
+	server.ConfigHttps(true)
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.RootCa)
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "HTTP/2.0" || resp.Proto != "HTTP/1.1" {
+			t.Fatalf("upstream %q, client %s", body, resp.Proto)
+		}
+	}
+	stats := server.TransportStats()
+	want := TransportStats{Requests: 3, NewConns: 1, ReusedConns: 2, HTTP2: 3}
+	if stats != want {
+		t.Fatalf("want %+v, got %+v", want, stats)
+	}
+
+	// 运行中替换连接池，正在转发的请求不受影响
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			server.ConfigTransport(DefaultTransportConfig())
+			_ = server.TransportStats()
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	<-done
+}
+
+func TestStreamingBody(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upload, _ := io.Copy(io.Discard, r.Body)
+		_, _ = fmt.Fprintf(w, "first %d\n", upload)
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/stream" {
+			<-release
+		}
+		_, _ = w.Write([]byte("second\n"))
+	}))
+	defer origin.Close()
+
+	var bodies sync.Map
+	server := NewServer("")
+	server.ConfigStreaming(true, func(data model.RequestData) bool {
+		return data.Url == "/buffer"
+	})
+	server.ConfigOnResponse(func(data model.ResponseData) model.ResponseData {
+		bodies.Store(data.ID, data.Body)
+		return model.ResponseData{Code: -1}
+	})
+	_, client, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	payload := strings.Repeat("x", 1<<20)
+	resp, err := client.Post(origin.URL+"/stream", "text/plain", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != fmt.Sprintf("first %d\n", len(payload)) {
+		t.Fatalf("unexpected first line %q: %v", line, err)
+	}
+	close(release)
+	_ = resp.Body.Close()
+
+	resp, err = client.Get(origin.URL + "/buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	var buffered []string
+	bodies.Range(func(key, value any) bool {
+		if value != "" {
+			buffered = append(buffered, value.(string))
+		}
+		return true
+	})
+	if len(buffered) != 1 || buffered[0] != "first 0\nsecond\n" {
+		t.Fatalf("unexpected buffered bodies %q", buffered)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(": ping\n\nid: 1\ndata: hello\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("event: drop\ndata: secret\n\ndata: bye\n\n"))
+	}))
+	defer origin.Close()
+
+	server := NewServer("")
+	server.ConfigStreamResponse(false, func(data model.EventData) model.EventData {
+		if data.Event == "drop" {
+			data.Drop = true
+		}
+		data.Data = strings.ToUpper(data.Data)
+		return data
+	})
+	_, client, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	var first []string
+	for len(first) < 5 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		first = append(first, line)
+	}
+	if got := strings.Join(first, ""); got != ": ping\n\nid: 1\ndata: HELLO\n\n" {
+		t.Fatalf("unexpected first events %q", got)
+	}
+	close(release)
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != "data: BYE\n\n" {
+		t.Fatalf("unexpected rest %q", rest)
+	}
+}
+
+func TestHookValue(t *testing.T) {
+	// 钩子返回零值表示不改写，设置 Modified 后空内容也生效
+	cases := []struct {
+		value    string
+		modified bool
+		want     string
+	}{
+		{"", false, "original"},
+		{"changed", false, "changed"},
+		{"", true, ""},
+		{"changed", true, "changed"},
+	}
+	for _, c := range cases {
+		if got := hookValue(c.value, "original", c.modified); got != c.want {
+			t.Fatalf("hookValue(%q, %v) = %q, want %q", c.value, c.modified, got, c.want)
+		}
+		if got := hookValue([]byte(c.value), []byte("original"), c.modified); string(got) != c.want {
+			t.Fatalf("hookValue([]byte(%q), %v) = %q, want %q", c.value, c.modified, got, c.want)
+		}
+	}
+}
+
+func TestTransparentTLS(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin " + r.Host))
+	}))
+	defer origin.Close()
+	originPort := origin.Listener.Addr().(*net.TCPAddr).Port
+
+	certificate := newTestCertificate(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.RootCa)
+
+	for _, mitm := range []bool{false, true} {
+		var hooks atomic.Int32
+		server := NewServer("")
+		server.ConfigCertificate(certificate)
+		server.ConfigHttps(mitm)
+		server.ConfigSniPort(originPort)
+		server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+			hooks.Add(1)
+			return model.RequestData{}
+		})
+		proxyAddr, _, shutdown := startProxy(t, server)
+
+		// 客户端直接连到代理，不发送 CONNECT
+		tlsConfig := &tls.Config{RootCAs: pool}
+		if !mitm {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", proxyAddr)
+			},
+			TLSClientConfig: tlsConfig,
+		}}
+		resp, err := client.Get(fmt.Sprintf("https://localhost:%d/", originPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		client.CloseIdleConnections()
+		shutdown()
+		if !strings.HasPrefix(string(body), "origin localhost") {
+			t.Fatalf("mitm %v: unexpected body %q", mitm, body)
+		}
+		if want := map[bool]int32{false: 0, true: 1}[mitm]; hooks.Load() != want {
+			t.Fatalf("mitm %v: want %d hooks, got %d", mitm, want, hooks.Load())
+		}
+	}
+}
+
+func TestConnectTunnel(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	tunnels := make(chan model.TunnelData, 1)
+	server := NewServer("")
+	server.ConfigOnTunnel(func(data model.TunnelData) {
+		tunnels <- data
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	conn, _ := net.Dial("tcp", proxyAddr)
+	_, _ = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", echo.Addr())
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", resp, err)
+	}
+	_, _ = conn.Write([]byte("ping\n"))
+	line, _ := reader.ReadString('\n')
+	if line != "ping\n" {
+		t.Fatalf("unexpected echo %q", line)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	_, _ = io.ReadAll(reader)
+	_ = conn.Close()
+
+	select {
+	case data := <-tunnels:
+		if data.Protocol != model.TunnelConnect || data.Host != echo.Addr().String() || data.BytesOut != 5 || data.BytesIn != 5 {
+			t.Fatalf("unexpected tunnel data %+v", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel hook not called")
+	}
+}
+
+func TestInterceptPolicy(t *testing.T) {
+	server := NewServer("")
+	if err := server.ConfigIntercept(
+		[]string{"*.example.com", "api.test:8443", "10.0.0.0/8", "[::1]:443"},
+		[]string{"bank.example.com", "*:8444"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]bool{
+		"www.example.com:443":  true,
+		"example.com:443":      false,
+		"bank.example.com:443": false,
+		"api.test:8443":        true,
+		"api.test:443":         false,
+		"10.1.2.3:443":         true,
+		"10.1.2.3:8444":        false,
+		"11.1.2.3:443":         false,
+		"[::1]:443":            true,
+		"[::1]:80":             false,
+	} {
+		if got := server.shouldIntercept(target); got != want {
+			t.Errorf("%s: want %v, got %v", target, want, got)
+		}
+	}
+	if err := server.ConfigIntercept(nil, []string{"bad:port"}); err == nil {
+		t.Fatal("expected invalid rule error")
+	}
+
+	// 命中 deny 的 CONNECT 不解密，客户端看到的是源站证书
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	var hooks atomic.Int32
+	server = NewServer("")
+	server.ConfigCertificate(newTestCertificate(t))
+	server.ConfigHttps(true)
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		hooks.Add(1)
+		return model.RequestData{}
+	})
+	_ = server.ConfigIntercept(nil, []string{"127.0.0.1"})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()},
+	}}
+	client.Transport.(*http.Transport).TLSClientConfig.RootCAs.AddCert(origin.Certificate())
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if hooks.Load() != 0 {
+		t.Fatal("denied host should not be intercepted")
+	}
+}
+
+func TestPassthroughLearning(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	server := NewServer("")
+	server.ConfigCertificate(newTestCertificate(t))
+	server.ConfigHttps(true)
+	server.ConfigPassthroughLearning(2)
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+	// 建立隧道后不握手直接断开，不算客户端拒绝证书
+	host := strings.TrimPrefix(origin.URL, "https://")
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT failed: %v", err)
+		}
+		_ = conn.Close()
+	}
+	for server.connCount() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if entries := server.PassthroughEntries(); len(entries) != 0 {
+		t.Fatalf("closed connections should not be learned: %+v", entries)
+	}
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	// 客户端只信任源站证书，模拟证书固定
+	pool := x509.NewCertPool()
+	pool.AddCert(origin.Certificate())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	for i := 0; i < 2; i++ {
+		if resp, err := client.Get(origin.URL); err == nil {
+			_ = resp.Body.Close()
+			t.Fatalf("attempt %d: expected handshake failure", i)
+		}
+	}
+	// 握手失败在代理侧异步记录，等待学习完成
+	deadline := time.Now().Add(2 * time.Second)
+	for !server.learner.passthrough("127.0.0.1") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "origin" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	entries := server.PassthroughEntries()
+	if len(entries) != 1 || entries[0].Host != "127.0.0.1" || !entries[0].Passthrough || entries[0].Failures != 2 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	server.ForgetPassthrough("127.0.0.1")
+	if !server.shouldIntercept("127.0.0.1:443") {
+		t.Fatal("forgotten host should be intercepted again")
+	}
+	// 客户端接受生成证书完成握手，但在首个请求前断开（OkHttp 证书固定校验失败）
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT failed: %v", err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("attempt %d: handshake failed: %v", i, err)
+		}
+		_ = tlsConn.Close()
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for !server.learner.passthrough("127.0.0.1") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if entries := server.PassthroughEntries(); len(entries) != 1 || !entries[0].Passthrough ||
+		entries[0].LastError != "client closed before first request" {
+		t.Fatalf("unexpected entries after early close %+v", entries)
+	}
+	server.ForgetPassthrough("127.0.0.1")
+	server.LoadPassthrough([]string{"Pinned.Example.com."})
+	if server.shouldIntercept("pinned.example.com:443") {
+		t.Fatal("loaded host should pass through")
+	}
+}
+
+func TestHTTP2Mitm(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = w.Write([]byte(r.Proto + ":" + string(body)))
+		w.Header().Set("X-Checksum", "ok")
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	certificate := newTestCertificate(t)
+	var hooks atomic.Int32
+	server := NewServer("")
+	server.ConfigCertificate(certificate)
+	server.ConfigHttps(true)
+	server.ConfigHTTP2(true)
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		hooks.Add(1)
+		return model.RequestData{Body: "rewritten"}
+	})
+	counted := &countListener{Listener: listenLocal(t)}
+	proxyAddr, _, shutdown := serveProxy(t, server, counted)
+	defer shutdown()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.RootCa)
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+	do := func() {
+		resp, err := client.Post(origin.URL, "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Errorf("client spoke %s to proxy", resp.Proto)
+		}
+		// 上游同样协商到 HTTP/2
+		if string(body) != "HTTP/2.0:rewritten" {
+			t.Errorf("unexpected body %q", body)
+		}
+		if resp.Trailer.Get("X-Checksum") != "ok" {
+			t.Errorf("missing trailer %v", resp.Trailer)
+		}
+	}
+	// 第一个请求建立连接后，并发请求复用同一连接上的不同流
+	do()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do()
+		}()
+	}
+	wg.Wait()
+	if hooks.Load() != 3 {
+		t.Fatalf("want 3 hook calls, got %d", hooks.Load())
+	}
+	if counted.count.Load() != 1 {
+		t.Fatalf("want 1 connection, got %d", counted.count.Load())
+	}
+}
+
+func TestParentProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	echo := startEcho(t)
+	defer echo.Close()
+
+	// 上级代理：HTTP 代理 parent 和需要认证的 SOCKS5 代理 socks，分别统计经过的请求和隧道
+	var parentRequests, socksRequests atomic.Int32
+	tunnels := make(chan model.TunnelData, 1)
+	parent := NewServer("")
+	parent.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		parentRequests.Add(1)
+		return data
+	})
+	parent.ConfigOnTunnel(func(data model.TunnelData) {
+		tunnels <- data
+	})
+	socks := NewServer("")
+	socks.ConfigSocksAuth(func(username, password string) bool {
+		return username == "user" && password == "pass"
+	})
+	socks.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		socksRequests.Add(1)
+		return data
+	})
+	parentAddr, _, shutdownParent := startProxy(t, parent)
+	defer shutdownParent()
+	socksAddr, _, shutdownSocks := startProxy(t, socks)
+	defer shutdownSocks()
+
+	server := NewServer("")
+	_, client, shutdown := startProxy(t, server)
+	defer shutdown()
+	get := func() {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "origin" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+
+	if err := server.ConfigParentProxy([]ParentProxy{{URL: "ftp://" + parentAddr}}); err == nil {
+		t.Fatal("expected unsupported scheme error")
+	}
+	// 解密后的请求和 CONNECT 隧道都经过 HTTP 上级代理
+	if err := server.ConfigParentProxy([]ParentProxy{{URL: "http://" + parentAddr}}); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	if parentRequests.Load() != 1 {
+		t.Fatalf("want 1 request through parent, got %d", parentRequests.Load())
+	}
+	conn, err := server.dialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("ping\n"))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	_ = conn.Close()
+	if line != "ping\n" {
+		t.Fatalf("unexpected echo %q", line)
+	}
+	select {
+	case data := <-tunnels:
+		if data.Host != echo.Addr().String() {
+			t.Fatalf("unexpected tunnel data %+v", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel did not go through parent")
+	}
+
+	// 按目标选择：命中 direct 规则的目标直连，其余走 SOCKS5
+	client.CloseIdleConnections()
+	if err := server.ConfigParentProxy([]ParentProxy{
+		{URL: ParentDirect, Hosts: []string{echo.Addr().String()}},
+		{URL: "socks5://user:pass@" + socksAddr, Hosts: []string{"127.0.0.1"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	if socksRequests.Load() != 1 || parentRequests.Load() != 1 {
+		t.Fatalf("want 1 request through socks, got %d (parent %d)", socksRequests.Load(), parentRequests.Load())
+	}
+	if got := server.parentFor(echo.Addr().String()); got != nil {
+		t.Fatalf("want direct, got %v", got)
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	// 源站挂在 /api 下，返回指向自己的跳转和带 Domain 的 Cookie
+	var originHost, forwardedHost string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originHost, forwardedHost = r.Host, r.Header.Get("X-Forwarded-Host")
+		if r.URL.Path == "/api/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Domain: "127.0.0.1", Path: "/api/user"})
+			http.Redirect(w, r, "http://"+r.Host+"/api/user?from=login", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("origin:" + r.URL.RequestURI()))
+	}))
+	defer origin.Close()
+
+	server := NewServer("")
+	if err := server.ConfigReverse(origin.URL + "/api/"); err != nil {
+		t.Fatal(err)
+	}
+	var requests, responses atomic.Int32
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		requests.Add(1)
+		return data
+	})
+	server.ConfigOnResponse(func(data model.ResponseData) model.ResponseData {
+		responses.Add(1)
+		return data
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	// 客户端不配置代理，直接访问监听地址
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	base := "http://localhost:" + strings.Split(proxyAddr, ":")[1]
+	response, err := client.Get(base + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if originHost != strings.TrimPrefix(origin.URL, "http://") || !strings.HasPrefix(forwardedHost, "localhost:") {
+		t.Fatalf("unexpected upstream host %q, forwarded %q", originHost, forwardedHost)
+	}
+	if location := response.Header.Get("Location"); location != base+"/user?from=login" {
+		t.Fatalf("unexpected location %q", location)
+	}
+	if cookie := response.Header.Get("Set-Cookie"); cookie != "session=1; Path=/user; Domain=localhost" {
+		t.Fatalf("unexpected cookie %q", cookie)
+	}
+
+	response, err = client.Get(base + "/user?from=login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if string(body) != "origin:/api/user?from=login" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if requests.Load() != 2 || responses.Load() != 2 {
+		t.Fatalf("want 2 hook calls, got %d requests and %d responses", requests.Load(), responses.Load())
+	}
+
+	// 反向代理模式不接受 CONNECT
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	response, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || response.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected CONNECT response %v, %v", response, err)
+	}
+}
+
+func TestReverseBalance(t *testing.T) {
+	// 三个后端各自回显名字，b 的健康检查失败
+	var unhealthy atomic.Bool
+	backends := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" && name == "b" && unhealthy.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte(name))
+		}))
+		defer origin.Close()
+		backends[origin.URL] = name
+	}
+	var upstreams []string
+	for upstream := range backends {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Slice(upstreams, func(i, j int) bool {
+		return backends[upstreams[i]] < backends[upstreams[j]]
+	})
+	// 已关闭的后端，连接失败后被动摘除
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	server := NewServer("")
+	backendURLs := make(chan string, 100)
+	server.ConfigOnResponse(func(data model.ResponseData) model.ResponseData {
+		if data.Backend != nil {
+			backendURLs <- data.Backend.URL
+		}
+		return data
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+	client := &http.Client{Timeout: 5 * time.Second}
+	get := func(header string) string {
+		request, _ := http.NewRequest(http.MethodGet, "http://"+proxyAddr+"/", nil)
+		if header != "" {
+			request.Header.Set("X-User", header)
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	// 轮询
+	if err := server.ConfigReverseBalance(ReverseConfig{Upstreams: upstreams}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, get(""))
+	}
+	if strings.Join(got, "") != "abcabc" {
+		t.Fatalf("unexpected round robin order %v", got)
+	}
+	if backendURL := <-backendURLs; backends[backendURL] != "a" {
+		t.Fatalf("unexpected backend in ResponseData %q", backendURL)
+	}
+
+	// 一致性哈希：同一个键落到同一个后端
+	if err := server.ConfigReverseBalance(ReverseConfig{Upstreams: upstreams, Balance: BalanceHash, HashHeader: "X-User"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		first := get(user)
+		for i := 0; i < 3; i++ {
+			if next := get(user); next != first {
+				t.Fatalf("user %s moved from %s to %s", user, first, next)
+			}
+		}
+	}
+
+	// 主动健康检查摘除 b
+	unhealthy.Store(true)
+	if err := server.ConfigReverseBalance(ReverseConfig{
+		Upstreams:      upstreams,
+		Balance:        BalanceLeastConn,
+		HealthPath:     "/health",
+		HealthInterval: 20 * time.Millisecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.ReverseBackends()[1].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("health check did not mark backend unhealthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 6; i++ {
+		if name := get(""); name == "b" {
+			t.Fatal("request routed to unhealthy backend")
+		}
+	}
+
+	// 被动摘除：连续两次连接失败后不再选中
+	if err := server.ConfigReverseBalance(ReverseConfig{
+		Upstreams: []string{closed.URL, upstreams[0]},
+		MaxFails:  2,
+		EjectTime: time.Minute,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		get("")
+	}
+	stats := server.ReverseBackends()
+	if !stats[0].Ejected || stats[0].Failures != 2 || stats[0].Requests != 2 || stats[1].Requests != 6 || stats[1].Active != 0 {
+		t.Fatalf("unexpected backend stats %+v", stats)
+	}
+}
+
+// tproxyConn 模拟 TPROXY 接受的连接：本地地址就是原始目标
+type tproxyConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c tproxyConn) LocalAddr() net.Addr { return c.local }
+
+func TestTransparentProxy(t *testing.T) {
+	// 目标主机名无法解析，只能按原始目标连接
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("http " + r.Host))
+	}))
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("https " + r.Host))
+	}))
+	defer tlsOrigin.Close()
+	echo := startEcho(t)
+	defer echo.Close()
+
+	certificate := newTestCertificate(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.RootCa)
+	server := NewServer("")
+	server.ConfigCertificate(certificate)
+	server.ConfigHttps(true)
+	if err := server.ConfigTransparent(TransparentTProxy); err != nil {
+		t.Fatal(err)
+	}
+	hosts := make(chan string, 2)
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		hosts <- data.Host
+		return data
+	})
+	tunnels := make(chan model.TunnelData, 1)
+	server.ConfigOnTunnel(func(data model.TunnelData) {
+		tunnels <- data
+	})
+	defer server.Close()
+
+	// dial 连接代理，代理看到的本地地址为 target
+	dial := func(target net.Addr) net.Conn {
+		client, proxied := net.Pipe()
+		go server.ServeConn(tproxyConn{Conn: proxied, local: target})
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		return client
+	}
+
+	conn := dial(origin.Listener.Addr())
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: app.internal\r\nConnection: close\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	_ = conn.Close()
+	if string(body) != "http app.internal" || <-hosts != "app.internal" {
+		t.Fatalf("unexpected http body %q", body)
+	}
+
+	tlsConn := tls.Client(dial(tlsOrigin.Listener.Addr()), &tls.Config{ServerName: "app.internal", RootCAs: pool})
+	_, _ = io.WriteString(tlsConn, "GET / HTTP/1.1\r\nHost: app.internal\r\nConnection: close\r\n\r\n")
+	response, err = http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(response.Body)
+	_ = tlsConn.Close()
+	if string(body) != "https app.internal" || <-hosts != "app.internal" {
+		t.Fatalf("unexpected https body %q", body)
+	}
+
+	// 其它协议原样转发
+	conn = dial(echo.Addr())
+	_, _ = io.WriteString(conn, "\x00ping")
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "\x00ping" {
+		t.Fatalf("unexpected echo %q, %v", buf, err)
+	}
+	_ = conn.Close()
+	select {
+	case data := <-tunnels:
+		if data.Protocol != model.TunnelRaw || data.Host != echo.Addr().String() {
+			t.Fatalf("unexpected tunnel data %+v", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel hook not called")
+	}
+
+	// 服务端先发言的协议：客户端等待欢迎语，代理识别超时后原样转发
+	banner := listenLocal(t)
+	defer banner.Close()
+	go func() {
+		conn, err := banner.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "220 ready\r\n")
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = io.WriteString(conn, "250 "+line)
+	}()
+	conn = dial(banner.Addr())
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil || line != "220 ready\r\n" {
+		t.Fatalf("unexpected banner %q, %v", line, err)
+	}
+	_, _ = io.WriteString(conn, "HELO client\r\n")
+	if line, err := reader.ReadString('\n'); err != nil || line != "250 HELO client\r\n" {
+		t.Fatalf("unexpected reply %q, %v", line, err)
+	}
+	_ = conn.Close()
+	if data := <-tunnels; data.Protocol != model.TunnelRaw || data.Host != banner.Addr().String() {
+		t.Fatalf("unexpected tunnel data %+v", data)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	server := NewServer("")
+	if err := server.ConfigProxyProtocol([]string{"127.0.0.0/8", "::1"}); err != nil {
+		t.Fatal(err)
+	}
+	clients := make(chan string, 1)
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		clients <- data.ClientIp
+		return data
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	v2 := func(src, dst net.IP, sport, dport uint16) string {
+		payload := append(append([]byte{}, src...), dst...)
+		payload = append(payload, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+		family := byte(0x21)
+		if src.To4() != nil {
+			family = 0x11
+		}
+		header := append(append([]byte{}, proxyV2Signature...), 0x21, family, 0, byte(len(payload)))
+		return string(append(header, payload...))
+	}
+	for _, tc := range []struct {
+		header string
+		client string
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n", "203.0.113.7"},
+		{v2(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 5555, 80), "2001:db8::1"},
+		{v2(net.ParseIP("198.51.100.9").To4(), net.ParseIP("10.0.0.1").To4(), 5555, 80), "198.51.100.9"},
+		{"PROXY UNKNOWN\r\n", "127.0.0.1"},
+		{"", "127.0.0.1"},
+	} {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(conn, tc.header+"GET "+origin.URL+"/ HTTP/1.1\r\nHost: "+origin.Listener.Addr().String()+"\r\nConnection: close\r\n\r\n")
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		_ = conn.Close()
+		if err != nil || response.StatusCode != http.StatusOK {
+			t.Fatalf("header %q: unexpected response %v, %v", tc.header, response, err)
+		}
+		if client := <-clients; client != tc.client {
+			t.Fatalf("header %q: want client %s, got %s", tc.header, tc.client, client)
+		}
+	}
+
+	// UDP 中继绑定在代理实际的地址上，而不是头部中负载均衡器的地址
+	control, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = control.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(control, "PROXY TCP4 203.0.113.7 10.0.0.1 5555 1080\r\n")
+	_, _ = control.Write([]byte{socks5Version, 1, socksMethodNoAuth})
+	_, _ = io.ReadFull(control, make([]byte, 2))
+	_, _ = control.Write([]byte{socks5Version, socksCmdUDPAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	bind, err := readSocks5Reply(control)
+	_ = control.Close()
+	if err != nil || !bind.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("unexpected UDP relay address %v, %v", bind, err)
+	}
+
+	// 不可信来源的头部不解析，连接无法作为 HTTP 处理
+	if err := server.ConfigProxyProtocol([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\nGET "+origin.URL+"/ HTTP/1.1\r\nHost: "+origin.Listener.Addr().String()+"\r\n\r\n")
+	if response, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil && response.StatusCode == http.StatusOK {
+		t.Fatal("untrusted PROXY header was accepted")
+	}
+	select {
+	case client := <-clients:
+		t.Fatalf("hook called for untrusted connection with client %s", client)
+	default:
+	}
+}
+
+func TestProtocolDetector(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Method + " " + r.Proto))
+	}))
+	defer origin.Close()
+
+	server := NewServer("")
+	server.ConfigH2C(true)
+	// 自定义协议：MAGIC 开头，回显其后的一行
+	if err := server.RegisterProtocol(ProtocolDetector{
+		Name: "magic",
+		Detect: func(prefix []byte) DetectResult {
+			return detectLiteral(prefix, "MAGIC")
+		},
+		Handle: func(wrapReq model.WrapRequest) {
+			line, _ := wrapReq.Reader.ReadString('\n')
+			_, _ = io.WriteString(wrapReq.Conn, "echo "+strings.TrimPrefix(line, "MAGIC"))
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "MAGIC hi\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	_ = conn.Close()
+	if err != nil || line != "echo  hi\n" {
+		t.Fatalf("unexpected custom protocol reply %q, %v", line, err)
+	}
+
+	// 不在旧首字节列表中的方法
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	request, _ := http.NewRequest("TRACE", origin.URL, nil)
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if string(body) != "TRACE HTTP/1.1" {
+		t.Fatalf("unexpected TRACE body %q", body)
+	}
+
+	// h2c prior knowledge：连接以 HTTP/2 前言开头
+	h2c := &http.Client{Timeout: 5 * time.Second, Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial("tcp", proxyAddr)
+		},
+	}}
+	response, err = h2c.Get(origin.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if response.ProtoMajor != 2 || string(body) != "GET HTTP/1.1" {
+		t.Fatalf("unexpected h2c response %s %q", response.Proto, body)
+	}
+}
+
+func TestDetectPriority(t *testing.T) {
+	// 前面的识别器需要更多字节时，后面的识别器即使匹配也要等待
+	detectors := []ProtocolDetector{
+		{Name: "long", Detect: func(prefix []byte) DetectResult { return detectLiteral(prefix, "ABCD") }},
+		{Name: "short", Detect: func(prefix []byte) DetectResult { return detectLiteral(prefix, "AB") }},
+	}
+	for input, want := range map[string]string{"ABCD": "long", "ABCE": "short", "ABC": "short", "X": ""} {
+		got := detect(bufio.NewReader(strings.NewReader(input)), detectors)
+		name := ""
+		if got != nil {
+			name = got.Name
+		}
+		if name != want {
+			t.Fatalf("input %q: want %q, got %q", input, want, name)
+		}
+	}
+}
+
+func TestStreamHook(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	other := startEcho(t)
+	defer other.Close()
+
+	tunnels := make(chan model.TunnelData, 2)
+	server := NewServer("")
+	server.ConfigOnTunnel(func(data model.TunnelData) {
+		tunnels <- data
+	})
+	// echo 端口：上行打码并丢弃 drop 行，下行加前缀
+	var lock sync.Mutex
+	var chunks []model.StreamChunk
+	seen := make(chan struct{}, 10)
+	server.ConfigOnStream(echo.Addr().(*net.TCPAddr).Port, func(chunk model.StreamChunk) model.StreamChunk {
+		lock.Lock()
+		chunks = append(chunks, chunk)
+		lock.Unlock()
+		if !chunk.Upstream {
+			chunk.Payload = append([]byte("> "), chunk.Payload...)
+			return chunk
+		}
+		defer func() { seen <- struct{}{} }()
+		if string(chunk.Payload) == "drop\n" {
+			chunk.Drop = true
+		}
+		chunk.Payload = []byte(strings.ReplaceAll(string(chunk.Payload), "secret", "******"))
+		return chunk
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	connect := func(target net.Addr) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", target)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT failed: %v %v", resp, err)
+		}
+		return conn, reader
+	}
+
+	conn, reader := connect(echo.Addr())
+	for _, line := range []string{"auth secret\n", "drop\n", "get key\n"} {
+		// 等钩子处理完再写下一行，避免多行合并为一段
+		_, _ = io.WriteString(conn, line)
+		<-seen
+		if line == "drop\n" {
+			continue
+		}
+		reply, _ := reader.ReadString('\n')
+		if want := "> " + strings.ReplaceAll(line, "secret", "******"); reply != want {
+			t.Fatalf("want %q, got %q", want, reply)
+		}
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	_, _ = io.ReadAll(reader)
+	_ = conn.Close()
+	data := <-tunnels
+	// 实际发送：上行 12+8 字节，下行每行多 2 字节前缀
+	if data.BytesOut != 20 || data.BytesIn != 24 {
+		t.Fatalf("unexpected tunnel data %+v", data)
+	}
+	lock.Lock()
+	first := chunks[0]
+	lock.Unlock()
+	if first.ID == "" || first.Protocol != model.TunnelConnect || first.Host != echo.Addr().String() ||
+		!first.Upstream || first.Offset != 0 || first.ClientIp != "127.0.0.1" {
+		t.Fatalf("unexpected chunk metadata %+v", first)
+	}
+
+	// 其它端口不经过钩子
+	conn, reader = connect(other.Addr())
+	_, _ = io.WriteString(conn, "secret\n")
+	if reply, _ := reader.ReadString('\n'); reply != "secret\n" {
+		t.Fatalf("unexpected reply on unhooked port %q", reply)
+	}
+	_ = conn.Close()
+	<-tunnels
+
+	// 开启解密后，非 TLS 的 CONNECT 隧道仍按原始数据转发并经过钩子
+	server.ConfigHttps(true)
+	conn, reader = connect(echo.Addr())
+	_, _ = io.WriteString(conn, "auth secret\n")
+	<-seen
+	if reply, _ := reader.ReadString('\n'); reply != "> auth ******\n" {
+		t.Fatalf("unexpected reply with https enabled %q", reply)
+	}
+	_ = conn.Close()
+	<-tunnels
+	server.ConfigHttps(false)
+
+	// 运行中取消注册，新的隧道不再经过钩子
+	server.ConfigOnStream(echo.Addr().(*net.TCPAddr).Port, nil)
+	conn, reader = connect(echo.Addr())
+	_, _ = io.WriteString(conn, "secret\n")
+	if reply, _ := reader.ReadString('\n'); reply != "secret\n" {
+		t.Fatalf("unexpected reply after unregistering %q", reply)
+	}
+	_ = conn.Close()
+	<-tunnels
+}
@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+// 反向代理负载均衡策略
+const (
+	BalanceRoundRobin = "round-robin" // 轮询
+	BalanceLeastConn  = "least-conn"  // 处理中请求最少的后端
+	BalanceHash       = "hash"        // 一致性哈希，同一个键总是落到同一个后端
+)
+
+// ringReplicas 一致性哈希环上每个后端的虚拟节点数
+const ringReplicas = 160
+
+// ReverseConfig 反向代理后端配置，零值字段使用默认值
+type ReverseConfig struct {
+	Upstreams      []string      // 后端基础地址，例如 http://10.0.0.1:8080/api
+	Balance        string        // 负载均衡策略，默认 BalanceRoundRobin
+	HashHeader     string        // BalanceHash 使用的请求头，为空时按客户端 IP
+	HealthPath     string        // 主动健康检查路径，相对于后端主机根路径，为空时不检查
+	HealthInterval time.Duration // 健康检查间隔，默认 10 秒
+	MaxFails       int           // 连续失败多少次后摘除后端，0 表示不被动摘除
+	EjectTime      time.Duration // 被动摘除的时长，默认 30 秒
+}
+
+// reverseBackend 单个后端及其统计
+type reverseBackend struct {
+	base *url.URL
+
+	healthy      atomic.Bool
+	ejectedUntil atomic.Int64 // UnixNano
+	fails        atomic.Int32 // 连续失败次数
+	active       atomic.Int64
+	requests     atomic.Int64
+	failures     atomic.Int64
+}
+
+// ringNode 哈希环上的虚拟节点
+type ringNode struct {
+	hash    uint32
+	backend *reverseBackend
+}
+
+// ConfigReverseBalance 开启反向代理模式并在多个后端之间负载均衡，后端的选择、健康检查和摘除见 ReverseConfig。
+// 运行中调用立即生效，旧配置的健康检查随之停止
+func (s *Server) ConfigReverseBalance(config ReverseConfig) error {
+	if len(config.Upstreams) == 0 {
+		s.storeReverse(nil)
+		return nil
+	}
+	target := &reverseTarget{
+		balance:    config.Balance,
+		hashHeader: config.HashHeader,
+		maxFails:   int32(config.MaxFails),
+		ejectTime:  config.EjectTime,
+		stop:       make(chan struct{}),
+	}
+	switch target.balance {
+	case "":
+		target.balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn, BalanceHash:
+	default:
+		return fmt.Errorf("unsupported balance strategy %q", config.Balance)
+	}
+	if config.HealthPath != "" && !strings.HasPrefix(config.HealthPath, "/") {
+		return fmt.Errorf("invalid health path %q", config.HealthPath)
+	}
+	if target.ejectTime <= 0 {
+		target.ejectTime = 30 * time.Second
+	}
+	for _, upstream := range config.Upstreams {
+		base, err := url.Parse(upstream)
+		if err != nil {
+			return err
+		}
+		if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+			return fmt.Errorf("invalid reverse upstream %q", upstream)
+		}
+		base.Path = strings.TrimSuffix(base.Path, "/")
+		backend := &reverseBackend{base: base}
+		backend.healthy.Store(true)
+		target.backends = append(target.backends, backend)
+	}
+	if target.balance == BalanceHash {
+		target.buildRing()
+	}
+	s.storeReverse(target)
+
+	if config.HealthPath != "" {
+		interval := config.HealthInterval
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		go s.healthCheck(target, config.HealthPath, interval)
+	}
+	return nil
+}
+
+// ReverseBackends 返回反向代理各后端的统计，未开启反向代理时返回 nil
+func (s *Server) ReverseBackends() []model.BackendStats {
+	target := s.reverse.Load()
+	if target == nil {
+		return nil
+	}
+	stats := make([]model.BackendStats, 0, len(target.backends))
+	for _, backend := range target.backends {
+		stats = append(stats, backend.stats())
+	}
+	return stats
+}
+
+// storeReverse 替换反向代理配置并停止旧配置的健康检查
+func (s *Server) storeReverse(target *reverseTarget) {
+	if old := s.reverse.Swap(target); old != nil {
+		close(old.stop)
+	}
+}
+
+func (t *reverseTarget) buildRing() {
+	for _, backend := range t.backends {
+		for i := 0; i < ringReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(backend.base.String() + "#" + strconv.Itoa(i)))
+			t.ring = append(t.ring, ringNode{hash: hash, backend: backend})
+		}
+	}
+	sort.Slice(t.ring, func(i, j int) bool {
+		return t.ring[i].hash < t.ring[j].hash
+	})
+}
+
+// pick 按策略选择后端。所有后端都不可用时忽略健康状态，仍然从全部后端中选择
+func (t *reverseTarget) pick(req *http.Request, clientIP string) *reverseBackend {
+	now := time.Now().UnixNano()
+	ignoreHealth := true
+	for _, backend := range t.backends {
+		if backend.available(now) {
+			ignoreHealth = false
+			break
+		}
+	}
+	usable := func(backend *reverseBackend) bool {
+		return ignoreHealth || backend.available(now)
+	}
+
+	switch t.balance {
+	case BalanceHash:
+		key := clientIP
+		if t.hashHeader != "" {
+			if value := req.Header.Get(t.hashHeader); value != "" {
+				key = value
+			}
+		}
+		hash := crc32.ChecksumIEEE([]byte(key))
+		start := sort.Search(len(t.ring), func(i int) bool {
+			return t.ring[i].hash >= hash
+		})
+		for i := 0; i < len(t.ring); i++ {
+			node := t.ring[(start+i)%len(t.ring)]
+			if usable(node.backend) {
+				return node.backend
+			}
+		}
+	case BalanceLeastConn:
+		// 从轮询位置开始比较，处理中请求数相同的后端轮流被选中
+		offset := int(t.next.Add(1) - 1)
+		var best *reverseBackend
+		for i := range t.backends {
+			backend := t.backends[(offset+i)%len(t.backends)]
+			if usable(backend) && (best == nil || backend.active.Load() < best.active.Load()) {
+				best = backend
+			}
+		}
+		if best != nil {
+			return best
+		}
+	default:
+		offset := int(t.next.Add(1) - 1)
+		for i := range t.backends {
+			backend := t.backends[(offset+i)%len(t.backends)]
+			if usable(backend) {
+				return backend
+			}
+		}
+	}
+	return t.backends[0]
+}
+
+// record 记录一次转发结果，连续失败达到 maxFails 时摘除后端
+func (t *reverseTarget) record(backend *reverseBackend, failed bool) {
+	if !failed {
+		backend.fails.Store(0)
+		return
+	}
+	backend.failures.Add(1)
+	if t.maxFails > 0 && backend.fails.Add(1) >= t.maxFails {
+		backend.fails.Store(0)
+		backend.ejectedUntil.Store(time.Now().Add(t.ejectTime).UnixNano())
+		log.Printf("Reverse: eject %s for %s", backend.base.Host, t.ejectTime)
+	}
+}
+
+func (b *reverseBackend) available(now int64) bool {
+	return b.healthy.Load() && now >= b.ejectedUntil.Load()
+}
+
+func (b *reverseBackend) stats() model.BackendStats {
+	return model.BackendStats{
+		URL:      b.base.String(),
+		Healthy:  b.healthy.Load(),
+		Ejected:  time.Now().UnixNano() < b.ejectedUntil.Load(),
+		Active:   b.active.Load(),
+		Requests: b.requests.Load(),
+		Failures: b.failures.Load(),
+	}
+}
+
+// beginReverse 反向代理请求发往后端前调用，返回的函数在收到响应或出错后调用：
+// 记录结果、改写响应头，并在响应 Body 关闭时结束处理中计数。非反向代理请求返回空函数
+func beginReverse(request *http.Request) func(*http.Response, error) {
+	original, ok := request.Context().Value(reverseKey{}).(*reverseRequest)
+	if !ok {
+		return func(*http.Response, error) {}
+	}
+	backend := original.backend
+	backend.active.Add(1)
+	backend.requests.Add(1)
+	return func(response *http.Response, err error) {
+		if err != nil {
+			original.target.record(backend, true)
+			backend.active.Add(-1)
+			return
+		}
+		switch response.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			original.target.record(backend, true)
+		default:
+			original.target.record(backend, false)
+		}
+		rewriteReverseResponse(original, response)
+		if response.StatusCode == http.StatusSwitchingProtocols {
+			// 升级后的连接不计入处理中请求，Body 需要保持可写
+			backend.active.Add(-1)
+			return
+		}
+		response.Body = &backendBody{ReadCloser: response.Body, backend: backend}
+	}
+}
+
+// reverseBackendStats 响应所属反向代理后端的统计，用于 ResponseData
+func reverseBackendStats(response *http.Response) *model.BackendStats {
+	if response.Request == nil {
+		return nil
+	}
+	original, ok := response.Request.Context().Value(reverseKey{}).(*reverseRequest)
+	if !ok {
+		return nil
+	}
+	stats := original.backend.stats()
+	return &stats
+}
+
+// backendBody 响应 Body 关闭时结束后端的处理中计数
+type backendBody struct {
+	io.ReadCloser
+	once    sync.Once
+	backend *reverseBackend
+}
+
+func (b *backendBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.backend.active.Add(-1)
+	})
+	return err
+}
+
+// healthCheck 定期请求每个后端的 path，非 2xx/3xx 或请求失败时标记为不健康，直到下一次检查通过
+func (s *Server) healthCheck(target *reverseTarget, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, backend := range target.backends {
+			healthy := s.probe(backend, path, interval)
+			if backend.healthy.Swap(healthy) != healthy {
+				log.Printf("Reverse: backend %s healthy=%v", backend.base.Host, healthy)
+			}
+		}
+		select {
+		case <-target.stop:
+			return
+		case <-ticker.C:
+		}
+		if s.shuttingDown() {
+			return
+		}
+	}
+}
+
+func (s *Server) probe(backend *reverseBackend, path string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	probeURL := backend.base.Scheme + "://" + backend.base.Host + path
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return false
+	}
+	response, err := s.upstream.Load().transport.RoundTrip(request)
+	if err != nil {
+		return false
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+	return response.StatusCode >= 200 && response.StatusCode < 400
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// reverseTarget 反向代理模式的后端集合
+type reverseTarget struct {
+	backends   []*reverseBackend
+	balance    string
+	hashHeader string
+	ring       []ringNode // 仅 BalanceHash 使用
+	next       atomic.Uint64
+	maxFails   int32
+	ejectTime  time.Duration
+	stop       chan struct{} // 关闭后健康检查退出
+}
+
+// reverseKey 请求 context 中保存客户端看到的地址，transport 据此改写响应
+type reverseKey struct{}
+
+// reverseRequest 一个反向代理请求在客户端一侧的地址
+type reverseRequest struct {
+	target  *reverseTarget
+	backend *reverseBackend
+	host    string // 客户端请求的 Host
+	scheme  string
+}
+
+// ConfigReverse 开启反向代理模式：客户端无需配置代理，收到的 HTTP 请求全部转发到 upstream
+// （例如 https://api.example.com/v1），Host、Location 和 Set-Cookie 的域名随之改写，请求和响应钩子照常调用。
+// upstream 为空时关闭。多个后端见 ConfigReverseBalance
+func (s *Server) ConfigReverse(upstream string) error {
+	if upstream == "" {
+		return s.ConfigReverseBalance(ReverseConfig{})
+	}
+	return s.ConfigReverseBalance(ReverseConfig{Upstreams: []string{upstream}})
+}
+
+// rewriteRequest 把收到的请求改写为发往上游的请求
+func (t *reverseTarget) rewriteRequest(req *http.Request, clientIP string) *http.Request {
+	backend := t.pick(req, clientIP)
+	original := &reverseRequest{target: t, backend: backend, host: req.Host, scheme: "http"}
+	if req.TLS != nil {
+		original.scheme = "https"
+	}
+	base := backend.base
+
+	req.URL.Scheme = base.Scheme
+	req.URL.Host = base.Host
+	req.URL.Path = base.Path + req.URL.Path
+	if req.URL.RawPath != "" {
+		req.URL.RawPath = base.EscapedPath() + req.URL.RawPath
+	}
+	if base.RawQuery != "" {
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = base.RawQuery
+		} else {
+			req.URL.RawQuery = base.RawQuery + "&" + req.URL.RawQuery
+		}
+	}
+	req.Host = base.Host
+
+	if clientIP != "" {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		req.Header.Set("X-Forwarded-For", clientIP)
+	}
+	req.Header.Set("X-Forwarded-Host", original.host)
+	req.Header.Set("X-Forwarded-Proto", original.scheme)
+	return req.WithContext(context.WithValue(req.Context(), reverseKey{}, original))
+}
+
+// rewriteReverseResponse 反向代理请求的响应：把指向后端的 Location 和 Cookie 域名改回客户端看到的地址
+func rewriteReverseResponse(original *reverseRequest, response *http.Response) {
+	base := original.backend.base
+
+	if location := response.Header.Get("Location"); location != "" {
+		if u, err := url.Parse(location); err == nil && u.IsAbs() && strings.EqualFold(u.Host, base.Host) {
+			u.Scheme = original.scheme
+			u.Host = original.host
+			u.Path = stripBasePath(u.Path, base.Path)
+			u.RawPath = ""
+			response.Header.Set("Location", u.String())
+		} else if err == nil && !u.IsAbs() && strings.HasPrefix(location, "/") {
+			u.Path = stripBasePath(u.Path, base.Path)
+			u.RawPath = ""
+			response.Header.Set("Location", u.String())
+		}
+	}
+
+	cookies := response.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	clientHost := original.host
+	if host, _, err := net.SplitHostPort(clientHost); err == nil {
+		clientHost = host
+	}
+	response.Header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		response.Header.Add("Set-Cookie", rewriteCookie(cookie, base, clientHost))
+	}
+}
+
+// rewriteCookie 改写 Set-Cookie 中的 Domain 和 Path 属性，其它属性原样保留
+func rewriteCookie(cookie string, base *url.URL, clientHost string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			domain := strings.TrimPrefix(strings.ToLower(value), ".")
+			upstream := strings.ToLower(base.Hostname())
+			if domain == upstream || strings.HasSuffix(upstream, "."+domain) {
+				parts[i+1] = " Domain=" + clientHost
+			}
+		case "path":
+			if base.Path != "" {
+				parts[i+1] = " Path=" + stripBasePath(value, base.Path)
+			}
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// stripBasePath 去掉上游的路径前缀
+func stripBasePath(path, basePath string) string {
+	if basePath == "" || (path != basePath && !strings.HasPrefix(path, basePath+"/")) {
+		return path
+	}
+	path = strings.TrimPrefix(path, basePath)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+// SOCKS4/4a 协议常量
+const (
+	socks4Version      = 0x04
+	socks4ReplyVersion = 0x00
+
+	socks4CmdConnect = 0x01
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+
+	// socks4MaxField USERID 和 4a 域名的最大长度
+	socks4MaxField = 255
+)
+
+// handleSocks4 处理 SOCKS4 和 SOCKS4a 请求。SOCKS4 只有 USERID 没有密码，
+// 配置了 ConfigSocksAuth 时以空密码调用校验
+func (s *Server) handleSocks4(wrapReq model.WrapRequest) {
+	// VN CD DSTPORT DSTIP
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(wrapReq.Reader, header); err != nil {
+		return
+	}
+	userID, err := readNullString(wrapReq.Reader)
+	if err != nil {
+		log.Println("SOCKS4 USERID 错误：" + err.Error())
+		return
+	}
+
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+	host := ip.String()
+	// SOCKS4a：DSTIP 为 0.0.0.x（x 非 0）时，USERID 之后跟随由代理解析的域名
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = readNullString(wrapReq.Reader)
+		if err != nil || host == "" {
+			log.Println("SOCKS4a 域名错误")
+			_ = writeSocks4Reply(wrapReq.Conn, socks4Rejected, nil)
+			return
+		}
+	}
+
+	if header[1] != socks4CmdConnect {
+		_ = writeSocks4Reply(wrapReq.Conn, socks4Rejected, nil)
+		return
+	}
+	if s.config.socksAuth != nil && !s.config.socksAuth(userID, "") {
+		log.Println("SOCKS4 认证失败：" + userID)
+		_ = writeSocks4Reply(wrapReq.Conn, socks4Rejected, nil)
+		return
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	serverConn, err := s.dialContext(context.Background(), "tcp", target)
+	if err != nil {
+		log.Printf("连接到 %s 失败: %v\n", target, err)
+		_ = writeSocks4Reply(wrapReq.Conn, socks4Rejected, nil)
+		return
+	}
+	if err = writeSocks4Reply(wrapReq.Conn, socks4Granted, serverConn.RemoteAddr()); err != nil {
+		_ = serverConn.Close()
+		return
+	}
+	s.serveSocksStream(wrapReq, target, serverConn)
+}
+
+// readNullString 读取以 0 结尾的字符串
+func readNullString(r *bufio.Reader) (string, error) {
+	var buf []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= socks4MaxField {
+			return "", errors.New("field too long")
+		}
+		buf = append(buf, b)
+	}
+}
+
+// writeSocks4Reply VN CD DSTPORT DSTIP，addr 为目标实际地址，便于 4a 客户端得到解析结果
+func writeSocks4Reply(w io.Writer, code byte, addr net.Addr) error {
+	reply := make([]byte, 8)
+	reply[0] = socks4ReplyVersion
+	reply[1] = code
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(reply[2:4], uint16(tcpAddr.Port))
+			copy(reply[4:8], ip4)
+		}
+	}
+	_, err := w.Write(reply)
+	return err
+}
@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+// SOCKS5 协议常量（RFC 1928 / RFC 1929）
+const (
+	socks5Version = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksUserPassVersion = 0x01
+
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSuccess             = 0x00
+	socksRepGeneralFailure      = 0x01
+	socksRepNotAllowed          = 0x02
+	socksRepNetworkUnreachable  = 0x03
+	socksRepHostUnreachable     = 0x04
+	socksRepConnectionRefused   = 0x05
+	socksRepCommandNotSupported = 0x07
+	socksRepAddressNotSupported = 0x08
+
+	sniffTimeout = time.Second
+)
+
+// ConfigSocksAuth 配置 SOCKS5 用户名/密码认证，authCall 为 nil 时不需要认证
+func (s *Server) ConfigSocksAuth(authCall model.AuthCall) {
+	s.config.socksAuth = authCall
+}
+
+// handleSocks5 处理 SOCKS5 握手和请求
+func (s *Server) handleSocks5(wrapReq model.WrapRequest) {
+	if err := s.socks5Negotiate(wrapReq); err != nil {
+		log.Println("SOCKS5 握手失败：" + err.Error())
+		return
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(wrapReq.Reader, header); err != nil {
+		return
+	}
+	if header[0] != socks5Version {
+		log.Println("SOCKS5 版本错误：", header[0])
+		return
+	}
+	target, err := readSocksAddr(wrapReq.Reader)
+	if err != nil {
+		log.Println("SOCKS5 目标地址错误：" + err.Error())
+		_ = writeSocks5Reply(wrapReq.Conn, socksRepAddressNotSupported, nil)
+		return
+	}
+
+	switch header[1] {
+	case socksCmdConnect:
+		s.socks5Connect(wrapReq, target)
+	case socksCmdUDPAssociate:
+		s.socks5UDPAssociate(wrapReq, target)
+	default:
+		_ = writeSocks5Reply(wrapReq.Conn, socksRepCommandNotSupported, nil)
+	}
+}
+
+// socks5Negotiate 选择认证方式并完成认证
+func (s *Server) socks5Negotiate(wrapReq model.WrapRequest) error {
+	// VER NMETHODS METHODS
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(wrapReq.Reader, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(wrapReq.Reader, methods); err != nil {
+		return err
+	}
+
+	want := byte(socksMethodNoAuth)
+	if s.config.socksAuth != nil {
+		want = socksMethodUserPass
+	}
+	offered := false
+	for _, method := range methods {
+		if method == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		_, _ = wrapReq.Conn.Write([]byte{socks5Version, socksMethodNoAcceptable})
+		return errors.New("no acceptable authentication method")
+	}
+	if _, err := wrapReq.Conn.Write([]byte{socks5Version, want}); err != nil {
+		return err
+	}
+	if want == socksMethodUserPass {
+		return s.socks5UserPass(wrapReq)
+	}
+	return nil
+}
+
+// socks5UserPass RFC 1929 用户名/密码认证
+func (s *Server) socks5UserPass(wrapReq model.WrapRequest) error {
+	// VER ULEN UNAME PLEN PASSWD
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(wrapReq.Reader, header); err != nil {
+		return err
+	}
+	if header[0] != socksUserPassVersion {
+		return fmt.Errorf("unsupported auth version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(wrapReq.Reader, username); err != nil {
+		return err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(wrapReq.Reader, length); err != nil {
+		return err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(wrapReq.Reader, password); err != nil {
+		return err
+	}
+	if !s.config.socksAuth(string(username), string(password)) {
+		_, _ = wrapReq.Conn.Write([]byte{socksUserPassVersion, 0x01})
+		return errors.New("authentication failed for " + string(username))
+	}
+	_, err := wrapReq.Conn.Write([]byte{socksUserPassVersion, 0x00})
+	return err
+}
+
+// socks5Connect 处理 CONNECT 命令
+func (s *Server) socks5Connect(wrapReq model.WrapRequest, target string) {
+	serverConn, err := s.dialContext(context.Background(), "tcp", target)
+	if err != nil {
+		log.Printf("连接到 %s 失败: %v\n", target, err)
+		_ = writeSocks5Reply(wrapReq.Conn, socksReplyCode(err), nil)
+		return
+	}
+	if err = writeSocks5Reply(wrapReq.Conn, socksRepSuccess, serverConn.LocalAddr()); err != nil {
+		_ = serverConn.Close()
+		return
+	}
+	s.serveSocksStream(wrapReq, target, serverConn)
+}
+
+// serveSocksStream SOCKS 隧道建立后识别客户端发送的协议：自定义协议交给注册的识别器，
+// TLS 且开启 https 时解密拦截，明文 HTTP 直接拦截，其余协议原样转发
+func (s *Server) serveSocksStream(wrapReq model.WrapRequest, target string, serverConn net.Conn) {
+	sent, err := clientSpeaksFirst(wrapReq)
+	if err != nil {
+		_ = serverConn.Close()
+		return
+	}
+	if sent {
+		if protocol := detectWithin(wrapReq, s.config.protocols, s.socksProtocols(wrapReq, target)); protocol != nil {
+			_ = serverConn.Close()
+			protocol.Handle(wrapReq)
+			return
+		}
+	}
+	defer serverConn.Close()
+	s.tunnel(wrapReq, model.TunnelSocks, target, serverConn)
+}
+
+// socksProtocols SOCKS 隧道内拦截的协议
+func (s *Server) socksProtocols(wrapReq model.WrapRequest, target string) []ProtocolDetector {
+	protocols := []ProtocolDetector{
+		{Name: "http", Detect: detectHTTP, Handle: func(wrapReq model.WrapRequest) {
+			wrapReq.Https = false
+			s.serveRequests(wrapReq, func(wrapReq model.WrapRequest, req *http.Request) bool {
+				// SOCKS 隧道内是源站形式的请求，补全转发地址
+				req.URL.Scheme = "http"
+				if req.URL.Host == "" {
+					req.URL.Host = target
+				}
+				return s.serveHTTPRequest(wrapReq, req)
+			})
+		}},
+	}
+	if wrapReq.Https && s.shouldIntercept(target) {
+		host, _, _ := net.SplitHostPort(target)
+		protocols = append(protocols, ProtocolDetector{Name: "tls", Detect: detectTLS, Handle: func(wrapReq model.WrapRequest) {
+			s.mitm(wrapReq, host)
+		}})
+	}
+	return protocols
+}
+
+// clientSpeaksFirst 在限定时间内等待客户端首字节；服务端先发言的协议（如 SMTP、MySQL）客户端不会先发送数据，
+// 超时返回 false 表示按原始数据转发
+func clientSpeaksFirst(wrapReq model.WrapRequest) (bool, error) {
+	_ = wrapReq.Conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	_, err := wrapReq.Reader.Peek(1)
+	clearDeadline(wrapReq.Conn)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// readSocksAddr 读取 ATYP DST.ADDR DST.PORT，返回 host:port
+func readSocksAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		if length[0] == 0 {
+			return "", errors.New("empty domain name")
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// encodeSocksAddr 编码 ATYP BND.ADDR BND.PORT，addr 为空时返回 0.0.0.0:0
+func encodeSocksAddr(addr net.Addr) []byte {
+	ip := net.IPv4zero
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	var buf []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{socksAtypIPv4}, ip4...)
+	} else {
+		buf = append([]byte{socksAtypIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+// writeSocks5Reply VER REP RSV ATYP BND.ADDR BND.PORT
+func writeSocks5Reply(w io.Writer, rep byte, bind net.Addr) error {
+	reply := append([]byte{socks5Version, rep, 0x00}, encodeSocksAddr(bind)...)
+	_, err := w.Write(reply)
+	return err
+}
+
+// socksReplyCode 把拨号错误映射为 SOCKS5 应答码
+func socksReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksRepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksRepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socksRepHostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socksRepHostUnreachable
+	}
+	return socksRepGeneralFailure
+}
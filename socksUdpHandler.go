@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+const (
+	DefaultUDPIdleTimeout = 60 * time.Second
+	udpBufferSize         = 64 * 1024
+)
+
+// ConfigSocksUDP 配置 UDP ASSOCIATE：idleTimeout 内没有任何数据报时结束关联（0 使用默认值），
+// datagramCall 不为 nil 时每个数据报都会经过它，可以观察、改写或丢弃
+func (s *Server) ConfigSocksUDP(idleTimeout time.Duration, datagramCall model.DatagramCall) {
+	s.config.udpIdleTimeout = idleTimeout
+	s.config.datagramCall = datagramCall
+}
+
+// udpAssociation 一个 UDP ASSOCIATE 会话：relayConn 与客户端收发带 SOCKS 头的数据报，remoteConn 与目标收发原始数据
+type udpAssociation struct {
+	server     *Server
+	wrapReq    model.WrapRequest
+	relayConn  *net.UDPConn
+	remoteConn *net.UDPConn
+	clientIP   net.IP
+	clientPort int
+	clientAddr atomic.Pointer[net.UDPAddr]
+	lastActive atomic.Int64
+	resolved   sync.Map // host:port -> *net.UDPAddr
+}
+
+// socks5UDPAssociate 处理 UDP ASSOCIATE 命令，控制连接关闭或空闲超时后结束
+func (s *Server) socks5UDPAssociate(wrapReq model.WrapRequest, target string) {
+	// 使用原始连接的本地地址，PROXY protocol 头部中的目标是负载均衡器的地址
+	localIP := net.IPv4zero
+	if addr, ok := wrapReq.RawConn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Println("UDP 中继监听失败：" + err.Error())
+		_ = writeSocks5Reply(wrapReq.Conn, socksRepGeneralFailure, nil)
+		return
+	}
+	defer relayConn.Close()
+	remoteConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Println("UDP 出口监听失败：" + err.Error())
+		_ = writeSocks5Reply(wrapReq.Conn, socksRepGeneralFailure, nil)
+		return
+	}
+	defer remoteConn.Close()
+
+	assoc := &udpAssociation{
+		server:     s,
+		wrapReq:    wrapReq,
+		relayConn:  relayConn,
+		remoteConn: remoteConn,
+	}
+	if addr, ok := wrapReq.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		assoc.clientIP = addr.IP
+	}
+	// 客户端声明了发送端口时只接受该端口的数据报
+	if _, port, err := net.SplitHostPort(target); err == nil && port != "0" {
+		assoc.clientPort, _ = net.LookupPort("udp", port)
+	}
+	assoc.touch()
+
+	if err = writeSocks5Reply(wrapReq.Conn, socksRepSuccess, relayConn.LocalAddr()); err != nil {
+		return
+	}
+	clearDeadline(wrapReq.Conn)
+	s.setConnState(wrapReq, stateTunnel)
+
+	go assoc.clientLoop()
+	go assoc.remoteLoop()
+	done := make(chan struct{})
+	defer close(done)
+	go assoc.expire(done)
+
+	// RFC 1928：控制连接存活期间关联有效
+	_, _ = io.Copy(io.Discard, wrapReq.Reader)
+}
+
+func (a *udpAssociation) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+// expire 空闲超时后关闭控制连接，从而结束整个关联
+func (a *udpAssociation) expire(done <-chan struct{}) {
+	idle := a.server.config.udpIdleTimeout
+	if idle <= 0 {
+		idle = DefaultUDPIdleTimeout
+	}
+	ticker := time.NewTicker(idle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, a.lastActive.Load())) > idle {
+				log.Println("UDP 关联空闲超时：" + a.wrapReq.ID)
+				_ = a.wrapReq.Conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// clientLoop 解析客户端数据报并发往目标
+func (a *udpAssociation) clientLoop() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.relayConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.clientIP) || (a.clientPort != 0 && from.Port != a.clientPort) {
+			continue
+		}
+		// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA，不支持分片
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		reader := bytes.NewReader(buf[3:n])
+		target, err := readSocksAddr(reader)
+		if err != nil {
+			continue
+		}
+		a.clientAddr.Store(from)
+		a.touch()
+
+		payload := buf[n-reader.Len() : n]
+		data, ok := a.intercept(target, true, payload)
+		if !ok {
+			continue
+		}
+		addr, err := a.resolve(data.Target)
+		if err != nil {
+			log.Println("UDP 目标解析失败：" + err.Error())
+			continue
+		}
+		_, _ = a.remoteConn.WriteToUDP(data.Payload, addr)
+	}
+}
+
+// remoteLoop 把目标的响应加上 SOCKS 头发回客户端
+func (a *udpAssociation) remoteLoop() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.remoteConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		client := a.clientAddr.Load()
+		if client == nil {
+			continue
+		}
+		a.touch()
+
+		data, ok := a.intercept(from.String(), false, buf[:n])
+		if !ok {
+			continue
+		}
+		packet := append([]byte{0x00, 0x00, 0x00}, encodeSocksAddr(from)...)
+		packet = append(packet, data.Payload...)
+		_, _ = a.relayConn.WriteToUDP(packet, client)
+	}
+}
+
+// intercept 调用数据报钩子，返回 false 表示丢弃
+func (a *udpAssociation) intercept(target string, upstream bool, payload []byte) (model.DatagramData, bool) {
+	data := model.DatagramData{
+		ID:       a.wrapReq.ID,
+		ClientIp: a.clientIP.String(),
+		Target:   target,
+		Upstream: upstream,
+		Payload:  payload,
+	}
+	if a.server.config.datagramCall == nil {
+		return data, true
+	}
+	result := a.server.config.datagramCall(data)
+	if result.Drop {
+		return result, false
+	}
+	if result.Target == "" || !upstream {
+		result.Target = target
+	}
+	result.Payload = hookValue(result.Payload, payload, result.Modified)
+	return result, true
+}
+
+func (a *udpAssociation) resolve(target string) (*net.UDPAddr, error) {
+	if addr, ok := a.resolved.Load(target); ok {
+		return addr.(*net.UDPAddr), nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	a.resolved.Store(target, addr)
+	return addr, nil
+}
@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+// startEcho 启动回显服务
+func startEcho(t *testing.T) net.Listener {
+	ln := listenLocal(t)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// socks5Dial 最简 SOCKS5 客户端：无认证 CONNECT 到 IPv4 地址
+func socks5Dial(t *testing.T, proxyAddr string, target *net.TCPAddr) net.Conn {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte{socks5Version, 1, socksMethodNoAuth})
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil || reply[1] != socksMethodNoAuth {
+		t.Fatalf("method reply %v: %v", reply, err)
+	}
+	request := append([]byte{socks5Version, socksCmdConnect, 0, socksAtypIPv4}, target.IP.To4()...)
+	request = binary.BigEndian.AppendUint16(request, uint16(target.Port))
+	_, _ = conn.Write(request)
+	reply = make([]byte, 10)
+	if _, err = io.ReadFull(conn, reply); err != nil || reply[1] != socksRepSuccess {
+		t.Fatalf("connect reply %v: %v", reply, err)
+	}
+	return conn
+}
+
+func TestSocks5Relay(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	server := NewServer("")
+	// 隧道内同样识别自定义协议
+	if err := server.RegisterProtocol(ProtocolDetector{
+		Name: "magic",
+		Detect: func(prefix []byte) DetectResult {
+			return detectLiteral(prefix, "MAGIC")
+		},
+		Handle: func(wrapReq model.WrapRequest) {
+			line, _ := wrapReq.Reader.ReadString('\n')
+			_, _ = io.WriteString(wrapReq.Conn, "magic"+strings.TrimPrefix(line, "MAGIC"))
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	for _, c := range []struct{ send, want string }{
+		{"ping\n", "ping\n"},
+		{"MAGIC hi\n", "magic hi\n"},
+	} {
+		conn := socks5Dial(t, proxyAddr, echo.Addr().(*net.TCPAddr))
+		_, _ = conn.Write([]byte(c.send))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		_ = conn.Close()
+		if err != nil || line != c.want {
+			t.Fatalf("unexpected reply %q: %v", line, err)
+		}
+	}
+
+	// 长度为 0 的域名不拨号
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte{socks5Version, 1, socksMethodNoAuth})
+	_, _ = io.ReadFull(conn, make([]byte, 2))
+	_, _ = conn.Write([]byte{socks5Version, socksCmdConnect, 0, socksAtypDomain, 0, 0, 80})
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil || reply[1] != socksRepAddressNotSupported {
+		t.Fatalf("unexpected reply %v, %v", reply, err)
+	}
+}
+
+func TestSocks5Intercept(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("plain"))
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	defer secure.Close()
+
+	certificate := newTestCertificate(t)
+	var protocols atomic.Value
+	protocols.Store("")
+	server := NewServer("")
+	server.ConfigCertificate(certificate)
+	server.ConfigHttps(true)
+	server.ConfigSocksAuth(func(username, password string) bool {
+		return username == "user" && password == "pass"
+	})
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		protocols.Store(protocols.Load().(string) + data.Protocol + ";")
+		return model.RequestData{}
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.RootCa)
+	newClient := func(password string) *http.Client {
+		proxyURL := &url.URL{Scheme: "socks5", Host: proxyAddr, User: url.UserPassword("user", password)}
+		return &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+
+	client := newClient("pass")
+	for target, want := range map[string]string{plain.URL: "plain", secure.URL: "secure"} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != want {
+			t.Fatalf("want %q, got %q", want, body)
+		}
+	}
+	// 请求方法不限于常见的几种，使用新连接避免复用已识别的隧道
+	request, _ := http.NewRequest("MKCOL", plain.URL+"/dir", nil)
+	resp, err := newClient("pass").Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if got := protocols.Load().(string); len(got) != len("http;https;http;") {
+		t.Fatalf("unexpected hooks %q", got)
+	}
+
+	if _, err := newClient("wrong").Get(plain.URL); err == nil {
+		t.Fatal("expected authentication failure")
+	}
+}
+
+func TestSocks5UDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	server := NewServer("")
+	server.ConfigSocksUDP(200*time.Millisecond, func(data model.DatagramData) model.DatagramData {
+		if string(data.Payload) == "drop" {
+			data.Drop = true
+		}
+		if data.Upstream {
+			data.Payload = bytes.ToUpper(data.Payload)
+		}
+		return data
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	control, _ := net.Dial("tcp", proxyAddr)
+	defer control.Close()
+	_, _ = control.Write([]byte{socks5Version, 1, socksMethodNoAuth})
+	reply := make([]byte, 2)
+	_, _ = io.ReadFull(control, reply)
+	_, _ = control.Write([]byte{socks5Version, socksCmdUDPAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	bind, err := readSocks5Reply(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := net.DialUDP("udp", nil, bind)
+	defer client.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	for _, payload := range []string{"drop", "hello"} {
+		packet := append([]byte{0, 0, 0}, encodeSocksAddr(echoAddr)...)
+		_, _ = client.Write(append(packet, payload...))
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bytes.NewReader(buf[3:n])
+	source, _ := readSocksAddr(reader)
+	payload, _ := io.ReadAll(reader)
+	if source != echoAddr.String() || string(payload) != "HELLO" {
+		t.Fatalf("unexpected datagram from %s: %q", source, payload)
+	}
+
+	// 空闲超时后控制连接被关闭
+	_ = control.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = control.Read(buf); err != io.EOF {
+		t.Fatalf("association should expire, got %v", err)
+	}
+}
+
+// readSocks5Reply 读取 SOCKS5 应答中的绑定地址
+func readSocks5Reply(conn net.Conn) (*net.UDPAddr, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[1] != socksRepSuccess {
+		return nil, fmt.Errorf("reply %d", header[1])
+	}
+	addr, err := readSocksAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+func TestSocks4Relay(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	echoAddr := echo.Addr().(*net.TCPAddr)
+
+	server := NewServer("")
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	port := binary.BigEndian.AppendUint16(nil, uint16(echoAddr.Port))
+	for name, request := range map[string][]byte{
+		"socks4":  append(append([]byte{socks4Version, socks4CmdConnect}, port...), append(echoAddr.IP.To4(), "user\x00"...)...),
+		"socks4a": append(append([]byte{socks4Version, socks4CmdConnect}, port...), []byte("\x00\x00\x00\x01user\x00localhost\x00")...),
+	} {
+		conn, _ := net.Dial("tcp", proxyAddr)
+		_, _ = conn.Write(request)
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks4Granted {
+			t.Fatalf("%s: reply %v: %v", name, reply, err)
+		}
+		_, _ = conn.Write([]byte("ping\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		_ = conn.Close()
+		if err != nil || line != "ping\n" {
+			t.Fatalf("%s: unexpected echo %q: %v", name, line, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+// ConfigStreaming 开启后请求体和响应体以固定大小缓冲区边读边转发，钩子只能看到和修改头部；
+// bufferCall 返回 true 的请求仍完整缓冲，钩子可以读取和改写 Body。bufferCall 为 nil 时全部流式转发
+func (s *Server) ConfigStreaming(streaming bool, bufferCall model.BufferCall) {
+	s.config.streaming = streaming
+	s.config.bufferCall = bufferCall
+}
+
+// ConfigStreamResponse 配置流式响应：chunked 为 true 时长度未知的分块响应也边收边转发（不再缓冲给响应钩子），
+// eventCall 不为 nil 时 text/event-stream 的每个事件都会经过它，可以观察、改写或丢弃
+func (s *Server) ConfigStreamResponse(chunked bool, eventCall model.EventCall) {
+	s.config.streamChunked = chunked
+	s.config.eventCall = eventCall
+}
+
+// bufferFlow 当前请求是否需要完整缓冲
+func (s *Server) bufferFlow(wrapReq model.WrapRequest, req *http.Request) bool {
+	if !s.config.streaming {
+		return true
+	}
+	if s.config.bufferCall == nil {
+		return false
+	}
+	return s.config.bufferCall(newRequestData(wrapReq, req, nil))
+}
+
+// streamRequest 不缓冲 Body 转发请求和响应，返回连接是否可以继续复用
+func (s *Server) streamRequest(wrapReq model.WrapRequest, req *http.Request) bool {
+	clientClose := req.Close
+	removeHopHeaders(req.Header)
+
+	milli := time.Now().UnixMilli()
+	// 流式模式下钩子返回的 Body 不生效
+	interceptorRequest(wrapReq, req, nil)
+
+	response, err := s.transport(req)
+	if err != nil {
+		log.Println(err.Error())
+		s.writeDeadline(wrapReq.Conn)
+		return writeBadGateway(wrapReq.Conn, clientClose) == nil && !clientClose
+	}
+	defer response.Body.Close()
+
+	wrapReq.Duration = time.Now().UnixMilli() - milli
+	return s.writeStreamResponse(wrapReq, req, response, clientClose)
+}
+
+// streamingResponse 判断响应是否需要边收边转发：SSE、NDJSON 始终如此，
+// 长度未知的分块响应在 ConfigStreamResponse 开启 chunked 后也按流处理
+func (s *Server) streamingResponse(req *http.Request, response *http.Response) bool {
+	if !bodyAllowed(req.Method, response.StatusCode) {
+		return false
+	}
+	if isEventStream(response.Header) || isNDJSON(response.Header) {
+		return true
+	}
+	return s.config.streamChunked && response.ContentLength < 0
+}
+
+// writeStreamResponse 调用响应钩子（不含 Body）后逐块写回响应，SSE 事件交给事件钩子处理
+func (s *Server) writeStreamResponse(wrapReq model.WrapRequest, req *http.Request, response *http.Response, clientClose bool) bool {
+	interceptorResponse(wrapReq, response, nil)
+
+	if s.config.eventCall != nil && isEventStream(response.Header) && response.Header.Get("Content-Encoding") == "" {
+		response.Body = newEventReader(wrapReq.ID, response.Body, s.config.eventCall)
+		// 事件可能被改写，原始长度不再可信
+		response.ContentLength = -1
+		response.Header.Del("Content-Length")
+	}
+
+	removeHopHeaders(response.Header)
+	setKeepAliveHeader(req, response.Header)
+	response.Close = clientClose
+	response.TransferEncoding = nil
+	if response.ContentLength < 0 && bodyAllowed(req.Method, response.StatusCode) {
+		// 长度未知：HTTP/1.1 客户端使用分块编码，HTTP/1.0 客户端以关闭连接表示结束
+		if req.ProtoAtLeast(1, 1) {
+			response.TransferEncoding = []string{"chunked"}
+		} else {
+			response.Close = true
+		}
+	}
+
+	// 响应体持续时间不可预期，不设置写超时；Response.Write 以 32KB 缓冲区逐块拷贝 Body
+	err := response.Write(wrapReq.Conn)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	return !response.Close
+}
+
+// bodyAllowed HEAD 请求以及 1xx/204/304 响应没有响应体
+func bodyAllowed(method string, code int) bool {
+	if method == http.MethodHead {
+		return false
+	}
+	return code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified
+}
@@ -1,81 +1,201 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
-	"github.com/xyjwsj/request-proxy/model"
+	"io"
 	"log"
 	"net"
+	"strconv"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+	"github.com/xyjwsj/request-proxy/util"
 )
 
-// HandleTCP 处理 TCP/WebSocket 连接
+// recordTypeHandshake TLS 握手记录的首字节
+const recordTypeHandshake = 0x16
+
+// HandleTCP 处理未识别协议的连接：TLS 按 SNI 透传或拦截，其它协议没有目标地址，
+// 需要经 CONNECT、SOCKS 或透明代理模式转发，才能通过 ConfigOnStream 查看字节流
 func HandleTCP(wrapReq model.WrapRequest) {
-	defer wrapReq.Conn.Close()
+	defaultServer.handleTCP(wrapReq)
+}
 
-	// 1. 读取目标地址（例如 CONNECT 请求中的 Host 或 TLS ClientHello 中的 SNI）
-	targetAddr, err := net.ResolveTCPAddr("tcp", "0")
+func (s *Server) handleTCP(wrapReq model.WrapRequest) {
+	peek, err := wrapReq.Reader.Peek(1)
 	if err != nil {
-		log.Println("解析tcp代理目标地址错误：" + err.Error())
 		return
 	}
+	if peek[0] != recordTypeHandshake {
+		log.Printf("不支持的协议，首字节 0x%x，来自 %s", peek[0], wrapReq.Conn.RemoteAddr())
+		return
+	}
+	s.handleTLS(wrapReq, "")
+}
 
-	// 2. 连接到目标服务器
-	serverConn, err := net.DialTCP("tcp", nil, targetAddr)
+// ConfigSniPort 未经 CONNECT 直接到达的 TLS 连接按 SNI 连接目标时使用的端口，默认 443
+func (s *Server) ConfigSniPort(port int) {
+	s.config.sniPort = port
+}
+
+// handleTLS 处理未经 CONNECT 直接到达的 TLS 连接：读取 ClientHello 中的 SNI 和 ALPN 确定目标，
+// 开启 https 且客户端支持 HTTP/1.1（开启 HTTP/2 后也包括 h2）时解密拦截，否则原样转发。target 为空时使用 SNI 和 sniPort
+func (s *Server) handleTLS(wrapReq model.WrapRequest, target string) {
+	s.readDeadline(wrapReq.Conn)
+	hello, recorded, err := peekClientHello(wrapReq.Conn, wrapReq.Reader)
+	// 已读取的 ClientHello 放回读取器，后续握手或转发时重新读取
+	wrapReq.Reader = bufio.NewReader(io.MultiReader(bytes.NewReader(recorded), wrapReq.Reader))
 	if err != nil {
-		log.Printf("连接到 %s 失败: %v\n", targetAddr, err)
+		log.Println("读取 ClientHello 失败：" + err.Error())
 		return
 	}
-	defer serverConn.Close()
 
-	log.Printf("建立隧道: 客户端 <-> 代理 <-> %s", targetAddr)
+	host := hello.serverName
+	if target == "" {
+		if host == "" {
+			log.Println("ClientHello 中没有 SNI，无法确定目标：" + wrapReq.Conn.RemoteAddr().String())
+			return
+		}
+		port := s.config.sniPort
+		if port == 0 {
+			port = 443
+		}
+		target = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	if host == "" {
+		host, _, _ = net.SplitHostPort(target)
+	}
+	log.Printf("TLS 透明代理: %s ALPN %v", target, hello.protos)
+
+	if wrapReq.Https && s.canMitm(hello.protos) && s.shouldIntercept(net.JoinHostPort(host, targetPort(target))) {
+		s.mitm(wrapReq, host)
+		return
+	}
 
-	// 2. 根据 SNI 获取或生成子证书
-	host, port, _ := net.SplitHostPort(wrapReq.Conn.RemoteAddr().String())
-	cert, err := Cache.GetCertificate(host, port)
+	serverConn, err := s.dialContext(context.Background(), "tcp", target)
 	if err != nil {
-		log.Printf("Failed to get certificate for %s: %v", host, err)
-		_, _ = wrapReq.Writer.WriteString("HTTP/1.1 502 Bad Gateway\r\n\r\n")
-		_ = wrapReq.Writer.Flush()
+		log.Printf("连接到 %s 失败: %v\n", target, err)
 		return
 	}
+	defer serverConn.Close()
+	s.tunnel(wrapReq, model.TunnelSni, target, serverConn)
+}
 
-	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS10,
-		MaxVersion: tls.VersionTLS13,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
-		},
-		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			host := hello.ServerName
-			cert, err := Cache.GetCertificate(host, "443")
-			if err != nil {
-				return nil, err
-			}
-			if certInfo, ok := cert.(tls.Certificate); ok {
-				return &certInfo, nil
+// targetPort 返回 host:port 中的端口
+func targetPort(target string) string {
+	_, p, _ := net.SplitHostPort(target)
+	return p
+}
+
+// clientHello ClientHello 中代理关心的字段
+type clientHello struct {
+	serverName string
+	protos     []string
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// sniffConn 只读连接：读取经由 reader，写入直接失败，用于借助 crypto/tls 解析 ClientHello 而不真正握手
+type sniffConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c sniffConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c sniffConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c sniffConn) Close() error                { return nil }
+
+// peekClientHello 解析 ClientHello，返回解析结果和期间从 reader 读出的原始字节
+func peekClientHello(conn net.Conn, reader io.Reader) (*clientHello, []byte, error) {
+	var recorded bytes.Buffer
+	var hello *clientHello
+	err := tls.Server(sniffConn{Conn: conn, reader: io.TeeReader(reader, &recorded)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &clientHello{
+				serverName: info.ServerName,
+				protos:     append([]string(nil), info.SupportedProtos...),
 			}
-			return nil, errors.New("invalid certificate type")
+			return nil, errHelloRead
 		},
-		Certificates: []tls.Certificate{cert.(tls.Certificate)},
+	}).Handshake()
+	if hello == nil {
+		return nil, recorded.Bytes(), err
 	}
+	return hello, recorded.Bytes(), nil
+}
 
-	// 3. 开始 TLS 握手
-	sslConn := tls.Server(wrapReq.Conn, tlsConfig)
-	err = sslConn.Handshake()
-	if err != nil {
-		log.Printf("TLS handshake failed: %v", err)
-		return
+// supportsHTTP1 客户端是否接受 HTTP/1.1（未声明 ALPN 时默认接受）
+func supportsHTTP1(protos []string) bool {
+	if len(protos) == 0 {
+		return true
 	}
+	for _, proto := range protos {
+		if proto == "http/1.1" {
+			return true
+		}
+	}
+	return false
+}
 
-	// 3. 双向转发数据
-	errChan := make(chan error, 2)
+// ConfigOnTunnel 隧道结束时回调，报告目标、双向字节数和持续时间
+func (s *Server) ConfigOnTunnel(onTunnel model.TunnelCall) {
+	s.config.tunnelCall = onTunnel
+}
+
+// tunnel 不解密，在客户端和目标之间转发字节，目标端口注册了字节流钩子时逐段经过钩子，结束后通过 TunnelCall 报告
+func (s *Server) tunnel(wrapReq model.WrapRequest, protocol, host string, serverConn net.Conn) {
+	clearDeadline(wrapReq.Conn)
+	s.setConnState(wrapReq, stateTunnel)
+	start := time.Now()
+	var out, in int64
+	if call := s.streamCall(host); call != nil {
+		out, in = relayStream(wrapReq.Conn, wrapReq.Reader, serverConn, call, model.StreamChunk{
+			ID:       wrapReq.ID,
+			Protocol: protocol,
+			ClientIp: util.GetClientIP(wrapReq.Conn),
+			Host:     host,
+		})
+	} else {
+		out, in = relay(wrapReq.Conn, wrapReq.Reader, serverConn)
+	}
+	if s.config.tunnelCall != nil {
+		s.config.tunnelCall(model.TunnelData{
+			ID:       wrapReq.ID,
+			Protocol: protocol,
+			ClientIp: util.GetClientIP(wrapReq.Conn),
+			Host:     host,
+			BytesOut: out,
+			BytesIn:  in,
+			Duration: time.Since(start).Milliseconds(),
+		})
+	}
+}
 
-	//go transferData(wrapReq.Conn, serverConn, errChan)
-	//go transferData(serverConn, wrapReq.Conn, errChan)
+// relay 在客户端和上游之间双向拷贝数据，一个方向结束后半关闭对端，两个方向都结束才返回。
+// clientReader 为客户端连接上已带缓冲的读取器，返回上行（客户端到上游）和下行字节数
+func relay(client net.Conn, clientReader io.Reader, server net.Conn) (int64, int64) {
+	var down int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		down, _ = io.Copy(client, server)
+		closeWrite(client)
+	}()
+	up, _ := io.Copy(server, clientReader)
+	closeWrite(server)
+	<-done
+	return up, down
+}
 
-	// 等待任意一方关闭
-	<-errChan
+// closeWrite 支持半关闭时只关闭写方向，否则直接关闭连接
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
 }
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+// streamChunkSize 字节流钩子每次读取的最大字节数
+const streamChunkSize = 32 * 1024
+
+// ConfigOnStream 为目标端口注册字节流钩子：不解密的隧道（CONNECT、SOCKS、SNI 透传、透明代理的非 HTTP 连接）
+// 每读到一段数据就调用一次，钩子可以改写或丢弃这段数据（见 model.StreamChunk）。
+// port 为 0 时匹配没有单独注册的所有端口，onStream 为 nil 时取消注册，运行中调用对新的隧道生效。
+// 同一方向的调用按顺序进行，两个方向的调用可能并发
+func (s *Server) ConfigOnStream(port int, onStream model.StreamCall) {
+	for {
+		old := s.streams.Load()
+		calls := map[int]model.StreamCall{}
+		if old != nil {
+			for p, call := range *old {
+				calls[p] = call
+			}
+		}
+		if onStream == nil {
+			delete(calls, port)
+		} else {
+			calls[port] = onStream
+		}
+		// 并发注册时基于最新的表重试，避免覆盖其它端口
+		if s.streams.CompareAndSwap(old, &calls) {
+			return
+		}
+	}
+}
+
+// streamCall 返回目标（host:port）使用的字节流钩子
+func (s *Server) streamCall(target string) model.StreamCall {
+	loaded := s.streams.Load()
+	if loaded == nil || len(*loaded) == 0 {
+		return nil
+	}
+	calls := *loaded
+	if port, err := strconv.Atoi(targetPort(target)); err == nil {
+		if call, ok := calls[port]; ok {
+			return call
+		}
+	}
+	return calls[0]
+}
+
+// relayStream 与 relay 相同，但每段数据先交给钩子，返回实际发送的上行和下行字节数
+func relayStream(client net.Conn, clientReader io.Reader, server net.Conn, call model.StreamCall, meta model.StreamChunk) (int64, int64) {
+	var down int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		down = pumpStream(client, server, call, meta, false)
+		closeWrite(client)
+	}()
+	up := pumpStream(server, clientReader, call, meta, true)
+	closeWrite(server)
+	<-done
+	return up, down
+}
+
+// pumpStream 单方向读取数据、调用钩子并写出，读到 EOF 或写入失败时返回写出的字节数
+func pumpStream(dst io.Writer, src io.Reader, call model.StreamCall, meta model.StreamChunk, upstream bool) int64 {
+	var offset, written int64
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			chunk := meta
+			chunk.Upstream = upstream
+			chunk.Offset = offset
+			chunk.Payload = append([]byte(nil), buf[:n]...)
+			offset += int64(n)
+
+			chunk = call(chunk)
+			if payload := hookValue(chunk.Payload, buf[:n], chunk.Modified); !chunk.Drop && len(payload) > 0 {
+				w, werr := dst.Write(payload)
+				written += int64(w)
+				if werr != nil {
+					return written
+				}
+			}
+		}
+		if err != nil {
+			return written
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+// 透明代理模式
+const (
+	TransparentRedirect = "redirect" // iptables REDIRECT，通过 SO_ORIGINAL_DST 取原始目标
+	TransparentTProxy   = "tproxy"   // iptables TPROXY，连接的本地地址就是原始目标，监听需使用 ListenTProxy
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is only supported on Linux")
+
+// ConfigTransparent 开启透明代理模式：应用无需配置代理，由 iptables 把流量导入监听端口，
+// 代理取得连接的原始目标后按 HTTP 或 TLS 处理，直接连接该目标而不是依赖 CONNECT 或 Host。
+// 取不到原始目标的连接（直接连到代理端口）按普通代理处理。mode 为空时关闭
+func (s *Server) ConfigTransparent(mode string) error {
+	switch mode {
+	case "", TransparentRedirect, TransparentTProxy:
+	default:
+		return fmt.Errorf("unsupported transparent mode %q", mode)
+	}
+	if mode == TransparentRedirect && !transparentSupported {
+		return errTransparentUnsupported
+	}
+	s.config.transparent = mode
+	return nil
+}
+
+// originalTarget 透明代理模式下连接的原始目标，取不到或连接直接发往代理时返回空
+func (s *Server) originalTarget(conn net.Conn) string {
+	if tc, ok := conn.(*trackedConn); ok {
+		conn = tc.Conn
+	}
+	switch s.config.transparent {
+	case TransparentRedirect:
+		dst, err := originalDst(conn)
+		if err != nil {
+			log.Println("SO_ORIGINAL_DST:", err)
+			return ""
+		}
+		if dst == nil || dst.String() == conn.LocalAddr().String() {
+			return ""
+		}
+		return dst.String()
+	case TransparentTProxy:
+		dst, ok := conn.LocalAddr().(*net.TCPAddr)
+		if !ok || s.isListenerAddr(dst) {
+			return ""
+		}
+		return dst.String()
+	}
+	return ""
+}
+
+// isListenerAddr 地址是否为代理自己的监听地址。监听未指定 IP 时只比较端口，TPROXY 应使用单独的端口
+func (s *Server) isListenerAddr(addr *net.TCPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ln := range s.listeners {
+		la, ok := ln.Addr().(*net.TCPAddr)
+		if ok && la.Port == addr.Port && (la.IP.IsUnspecified() || la.IP.Equal(addr.IP)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleTransparent 处理透明代理模式下的连接：HTTP 和 TLS 按原有流程拦截，其它协议原样转发到原始目标。
+// 客户端在 sniffTimeout 内没有发送数据时按服务端先发言的协议转发
+func (s *Server) handleTransparent(wrapReq model.WrapRequest) {
+	if protocol := detectWithin(wrapReq, s.transparentProtocols()); protocol != nil {
+		protocol.Handle(wrapReq)
+		return
+	}
+	serverConn, err := s.dialContext(context.Background(), "tcp", wrapReq.Target)
+	if err != nil {
+		log.Printf("连接到 %s 失败: %v\n", wrapReq.Target, err)
+		return
+	}
+	defer serverConn.Close()
+	s.tunnel(wrapReq, model.TunnelRaw, wrapReq.Target, serverConn)
+}
+
+// transparentProtocols 透明代理模式下拦截的协议，TLS 连接按原始目标而不是 SNI 和 sniPort 连接
+func (s *Server) transparentProtocols() []ProtocolDetector {
+	return []ProtocolDetector{
+		{Name: "http", Detect: detectHTTP, Handle: s.handleHTTP},
+		{Name: "tls", Detect: detectTLS, Handle: func(wrapReq model.WrapRequest) {
+			s.handleTLS(wrapReq, wrapReq.Target)
+		}},
+	}
+}
+
+// dialTargetKey 请求 context 中保存透明代理的原始目标，拨号时替换 Host 解析出的地址
+type dialTargetKey struct{}
+
+type dialTarget struct {
+	host   string // 请求 URL 的 host:port
+	target string // 原始目标 host:port
+}
+
+// withTarget 透明代理模式下让请求连接原始目标，Host 头和 TLS SNI 保持不变
+func withTarget(wrapReq model.WrapRequest, req *http.Request) *http.Request {
+	if wrapReq.Target == "" {
+		return req
+	}
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+	return req.WithContext(context.WithValue(req.Context(), dialTargetKey{}, dialTarget{host: host, target: wrapReq.Target}))
+}
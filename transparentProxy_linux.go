@@ -0,0 +1,91 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST，netfilter 头文件中定义
+	ip6tOriginalDst = 80 // IP6T_SO_ORIGINAL_DST
+	ipv6Transparent = 75 // IPV6_TRANSPARENT，syscall 包未定义
+)
+
+const transparentSupported = true
+
+// originalDst 读取经 iptables REDIRECT 的连接被改写前的目标地址，连接没有被改写时返回 nil
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("original destination: %T is not a socket", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			// sockaddr_in6 放在 IPv6MTUInfo 的开头
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			// 端口为网络字节序
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			dst = &net.TCPAddr{
+				IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+			return
+		}
+		// sockaddr_in 放在 IPv6Mreq 的开头
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		dst = &net.TCPAddr{
+			IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+			Port: int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errors.Is(sockErr, syscall.ENOENT) {
+		// 连接没有经过 NAT
+		return nil, nil
+	}
+	return dst, sockErr
+}
+
+// ListenTProxy 创建用于 iptables TPROXY 的监听，设置 IP_TRANSPARENT 以接受发往任意地址的连接，需要 CAP_NET_ADMIN
+func ListenTProxy(addr string) (net.Listener, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+					return
+				}
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return config.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+const transparentSupported = false
+
+func originalDst(net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+// ListenTProxy 创建用于 iptables TPROXY 的监听，仅支持 Linux
+func ListenTProxy(string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+	"github.com/xyjwsj/request-proxy/util"
+	"golang.org/x/net/http2"
+)
+
+// ConfigH2C 开启后代理自己接受明文 HTTP 的 h2c 升级，升级后的每个流都经过请求和响应钩子，
+// 其中的 gRPC 请求以 h2c prior knowledge 发往源站；关闭时 h2c 与其它 Upgrade 协议一样交给源站，101 之后原样转发字节
+func (s *Server) ConfigH2C(decode bool) {
+	s.config.h2c = decode
+}
+
+// isUpgrade 判断请求是否要求协议升级
+func isUpgrade(header http.Header) bool {
+	return headerHasToken(header, "Connection", "upgrade") && header.Get("Upgrade") != ""
+}
+
+// handleUpgrade 处理 Upgrade 请求：源站返回 101 后，WebSocket 在配置了消息钩子时按消息转发，
+// 其它协议双向转发字节并通过隧道钩子报告升级后的协议。返回后连接不再复用
+func (s *Server) handleUpgrade(wrapReq model.WrapRequest, req *http.Request) {
+	protocol := req.Header.Get("Upgrade")
+	if s.config.h2c && strings.EqualFold(protocol, "h2c") && req.URL.Scheme == "http" {
+		s.handleH2C(wrapReq, req)
+		return
+	}
+
+	clientClose := req.Close
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.Println("Read body error:", err)
+		return
+	}
+	body = interceptorRequest(wrapReq, req, body)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	websocket := s.config.webSocketCall != nil && isWebSocketUpgrade(req.Header)
+	kept := upgradeHeaders(req.Header)
+	removeHopHeaders(req.Header)
+	connection := []string{"Upgrade"}
+	for _, name := range slices.Sorted(maps.Keys(kept)) {
+		req.Header[name] = kept[name]
+		connection = append(connection, name)
+	}
+	req.Header.Set("Connection", strings.Join(connection, ", "))
+	req.Header.Set("Upgrade", protocol)
+	if websocket {
+		prepareWebSocketOffer(req.Header)
+	}
+
+	response, err := s.transport(req)
+	if err != nil {
+		log.Println(err.Error())
+		s.writeDeadline(wrapReq.Conn)
+		_ = writeBadGateway(wrapReq.Conn, clientClose)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		// 源站拒绝升级，原样返回后关闭连接
+		removeHopHeaders(response.Header)
+		response.Close = true
+		s.writeDeadline(wrapReq.Conn)
+		if err = response.Write(wrapReq.Conn); err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+	upstream, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Println("Upgrade: upstream body is not writable")
+		return
+	}
+
+	var deflate, serverTakeover bool
+	if websocket {
+		deflate, serverTakeover = acceptDeflate(response.Header)
+	}
+	s.writeDeadline(wrapReq.Conn)
+	if err = writeSwitchingProtocols(wrapReq.Writer, response.Header); err != nil {
+		log.Println("Write upgrade response failed:", err)
+		return
+	}
+	clearDeadline(wrapReq.Conn)
+	s.setConnState(wrapReq, stateTunnel)
+
+	if websocket {
+		s.serveWebSocket(wrapReq, req, upstream, deflate, serverTakeover)
+		return
+	}
+	start := time.Now()
+	out, in := relayUpgrade(wrapReq.Conn, wrapReq.Reader, upstream)
+	if s.config.tunnelCall != nil {
+		upgraded := response.Header.Get("Upgrade")
+		if upgraded == "" {
+			upgraded = protocol
+		}
+		s.config.tunnelCall(model.TunnelData{
+			ID:       wrapReq.ID,
+			Protocol: model.TunnelUpgrade,
+			Upgrade:  upgraded,
+			ClientIp: util.GetClientIP(wrapReq.Conn),
+			Host:     req.URL.Host,
+			BytesOut: out,
+			BytesIn:  in,
+			Duration: time.Since(start).Milliseconds(),
+		})
+	}
+}
+
+// upgradeHeaders 返回 Connection 中声明的非逐跳头部（例如 h2c 的 HTTP2-Settings），
+// 它们是升级协议的一部分，需要随升级请求转发给源站
+func upgradeHeaders(header http.Header) http.Header {
+	kept := http.Header{}
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || slices.Contains(hopHeaders, name) {
+				continue
+			}
+			if values := header.Values(name); len(values) > 0 {
+				kept[name] = values
+			}
+		}
+	}
+	return kept
+}
+
+// handleH2C 代理自己完成 h2c 升级：返回 101 后在客户端连接上以 HTTP/2 处理所有流，升级请求本身为 1 号流
+func (s *Server) handleH2C(wrapReq model.WrapRequest, req *http.Request) {
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Header.Get("HTTP2-Settings"), "="))
+	if err != nil {
+		log.Println("h2c: invalid HTTP2-Settings:", err)
+		s.writeDeadline(wrapReq.Conn)
+		_ = writeBadGateway(wrapReq.Conn, true)
+		return
+	}
+	// 升级请求的 Body 必须在切换协议前读完
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.Println("Read body error:", err)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	s.writeDeadline(wrapReq.Conn)
+	header := http.Header{"Connection": {"Upgrade"}, "Upgrade": {"h2c"}}
+	if err = writeSwitchingProtocols(wrapReq.Writer, header); err != nil {
+		log.Println("Write upgrade response failed:", err)
+		return
+	}
+	s.serveHTTP2(wrapReq, &util.BufferedConn{Conn: wrapReq.Conn, Reader: wrapReq.Reader}, &http2.ServeConnOpts{
+		UpgradeRequest: req,
+		Settings:       settings,
+	})
+}
+
+// writeSwitchingProtocols 写回 101 响应头
+func writeSwitchingProtocols(w io.Writer, header http.Header) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	if err := header.Write(buf); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// relayUpgrade 升级完成后在客户端和源站之间直接拷贝字节，返回上行和下行字节数
+func relayUpgrade(client net.Conn, clientReader io.Reader, server io.ReadWriteCloser) (int64, int64) {
+	var down int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		down, _ = io.Copy(client, server)
+		closeWrite(client)
+	}()
+	up, _ := io.Copy(server, clientReader)
+	_ = server.Close()
+	<-done
+	return up, down
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestUpgradePassthrough(t *testing.T) {
+	// 源站接受 Upgrade: echo，之后回显字节
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+	defer origin.Close()
+
+	server := NewServer("")
+	tunnels := make(chan model.TunnelData, 1)
+	server.ConfigOnTunnel(func(data model.TunnelData) {
+		tunnels <- data
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	host := strings.TrimPrefix(origin.URL, "http://")
+	_, _ = io.WriteString(conn, "GET "+origin.URL+"/ HTTP/1.1\r\nHost: "+host+"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+	_, _ = io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q, %v", buf, err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+
+	select {
+	case data := <-tunnels:
+		if data.Protocol != model.TunnelUpgrade || data.Upgrade != "echo" || data.BytesOut != 4 || data.BytesIn != 4 {
+			t.Fatalf("unexpected tunnel data %+v", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel hook not called")
+	}
+}
+
+func TestH2CPassthrough(t *testing.T) {
+	// 未开启 ConfigH2C 时升级请求交给源站，HTTP2-Settings 必须随之转发
+	received := make(chan http.Header, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		if r.Header.Get("HTTP2-Settings") == "" {
+			http.Error(w, "missing settings", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		_ = rw.Flush()
+	}))
+	defer origin.Close()
+
+	server := NewServer("")
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	host := strings.TrimPrefix(origin.URL, "http://")
+	_, _ = io.WriteString(conn, "GET "+origin.URL+"/ HTTP/1.1\r\nHost: "+host+
+		"\r\nConnection: Upgrade, HTTP2-Settings, Keep-Alive\r\nKeep-Alive: timeout=5\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+	header := <-received
+	if header.Get("HTTP2-Settings") != "AAMAAABkAAQAAP__" || header.Get("Connection") != "Upgrade, Http2-Settings" ||
+		header.Get("Keep-Alive") != "" {
+		t.Fatalf("unexpected upstream headers %v", header)
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin:" + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	server := NewServer("")
+	server.ConfigH2C(true)
+	var hooks atomic.Int32
+	server.ConfigOnRequest(func(data model.RequestData) model.RequestData {
+		hooks.Add(1)
+		return data
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	host := strings.TrimPrefix(origin.URL, "http://")
+	_, _ = io.WriteString(conn, "GET "+origin.URL+"/first HTTP/1.1\r\nHost: "+host+
+		"\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+
+	// 升级后发送连接前言，读取 1 号流（升级请求）的响应
+	_, _ = io.WriteString(conn, http2.ClientPreface)
+	framer := http2.NewFramer(conn, reader)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err = framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	var body bytes.Buffer
+	for done := false; !done; {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				_ = framer.WriteSettingsAck()
+			}
+		case *http2.MetaHeadersFrame:
+			status = f.PseudoValue("status")
+			done = f.StreamEnded()
+		case *http2.DataFrame:
+			body.Write(f.Data())
+			done = f.StreamEnded()
+		}
+	}
+	if status != "200" || body.String() != "origin:/first" {
+		t.Fatalf("unexpected response %s %q", status, body.String())
+	}
+	if hooks.Load() != 1 {
+		t.Fatalf("want 1 hook call, got %d", hooks.Load())
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// TransportConfig 上游连接池配置
+type TransportConfig struct {
+	MaxIdleConns          int           // 所有主机的空闲连接总数上限，0 表示不限制
+	MaxIdleConnsPerHost   int           // 每个主机保留的空闲连接数
+	MaxConnsPerHost       int           // 每个主机的最大连接数，0 表示不限制
+	IdleConnTimeout       time.Duration // 空闲连接保留时间
+	DialTimeout           time.Duration // 建立 TCP 连接超时
+	TLSHandshakeTimeout   time.Duration // 与上游 TLS 握手超时
+	ResponseHeaderTimeout time.Duration // 等待上游响应头超时
+	HTTP2                 bool          // 是否与上游协商 HTTP/2
+	InsecureSkipVerify    bool          // 是否跳过上游证书校验
+}
+
+// TransportStats 上游连接池统计
+type TransportStats struct {
+	Requests    int64 `json:"requests"`    // 转发的请求数
+	Errors      int64 `json:"errors"`      // 转发失败的请求数
+	NewConns    int64 `json:"newConns"`    // 新建的上游连接数
+	ReusedConns int64 `json:"reusedConns"` // 复用连接池中连接的次数
+	HTTP2       int64 `json:"http2"`       // 使用 HTTP/2 的请求数
+}
+
+// DefaultTransportConfig 默认连接池配置
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:          200,
+		MaxIdleConnsPerHost:   16,
+		MaxConnsPerHost:       0,
+		IdleConnTimeout:       90 * time.Second,
+		DialTimeout:           30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		HTTP2:                 true,
+		InsecureSkipVerify:    true,
+	}
+}
+
+// upstreamTransport 每个 Server 共享的上游 Transport 以及统计
+type upstreamTransport struct {
+	config    TransportConfig
+	transport *http.Transport
+	h2c       *http.Transport // 明文 HTTP/2（prior knowledge），用于 http:// 的 gRPC 请求
+	trace     *httptrace.ClientTrace
+
+	requests    atomic.Int64
+	errors      atomic.Int64
+	newConns    atomic.Int64
+	reusedConns atomic.Int64
+	http2       atomic.Int64
+}
+
+func (s *Server) newUpstreamTransport(config TransportConfig) *upstreamTransport {
+	upstream := &upstreamTransport{config: config}
+	upstream.transport = &http.Transport{
+		Proxy:                 s.parentProxyURL,
+		DialContext:           s.dialDirect,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		ForceAttemptHTTP2:     config.HTTP2,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+	}
+	if !config.HTTP2 {
+		// 非 nil 的空 map 关闭 HTTP/2 协商
+		upstream.transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	// gRPC 只能使用 HTTP/2，明文的 gRPC 请求不经升级直接以 HTTP/2 连接上游
+	upstream.h2c = upstream.transport.Clone()
+	upstream.h2c.TLSNextProto = nil
+	upstream.h2c.Protocols = new(http.Protocols)
+	upstream.h2c.Protocols.SetUnencryptedHTTP2(true)
+	upstream.trace = &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				upstream.reusedConns.Add(1)
+			} else {
+				upstream.newConns.Add(1)
+			}
+		},
+	}
+	return upstream
+}
+
+// ConfigTransport 替换上游连接池配置，旧连接池中的空闲连接会被关闭。运行中调用对之后的请求生效
+func (s *Server) ConfigTransport(config TransportConfig) {
+	if old := s.upstream.Swap(s.newUpstreamTransport(config)); old != nil {
+		old.closeIdleConnections()
+	}
+}
+
+// TransportStats 返回上游连接池统计
+func (s *Server) TransportStats() TransportStats {
+	upstream := s.upstream.Load()
+	return TransportStats{
+		Requests:    upstream.requests.Load(),
+		Errors:      upstream.errors.Load(),
+		NewConns:    upstream.newConns.Load(),
+		ReusedConns: upstream.reusedConns.Load(),
+		HTTP2:       upstream.http2.Load(),
+	}
+}
+
+// dialContext 与上游建立 TCP 连接，按规则经过上级代理
+func (s *Server) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if parent := s.parentFor(addr); parent != nil {
+		if upstream := s.upstream.Load(); upstream != nil && upstream.config.DialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, upstream.config.DialTimeout)
+			defer cancel()
+		}
+		return s.dialParent(ctx, parent, network, addr)
+	}
+	return s.dialDirect(ctx, network, addr)
+}
+
+// dialDirect 直接与目标或上级代理建立 TCP 连接，透明代理的请求连接原始目标
+func (s *Server) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	if target, ok := ctx.Value(dialTargetKey{}).(dialTarget); ok && target.host == addr {
+		addr = target.target
+	}
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	if upstream := s.upstream.Load(); upstream != nil {
+		dialer.Timeout = upstream.config.DialTimeout
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// transport 通过连接池把请求转发到上游
+func (s *Server) transport(request *http.Request) (*http.Response, error) {
+	upstream := s.upstream.Load()
+	upstream.requests.Add(1)
+	// WithContext 返回浅拷贝：清除服务端读取时设置的 RequestURI，客户端的 Connection: close 不影响上游连接复用
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), upstream.trace))
+	request.RequestURI = ""
+	request.Close = false
+	done := beginReverse(request)
+	roundTripper := upstream.transport
+	if request.URL.Scheme == "http" && isGrpc(request.Header) {
+		roundTripper = upstream.h2c
+	}
+	response, err := roundTripper.RoundTrip(request)
+	done(response, err)
+	if err != nil {
+		upstream.errors.Add(1)
+		return nil, err
+	}
+	if response.ProtoMajor == 2 {
+		upstream.http2.Add(1)
+	}
+	// 客户端连接始终是 HTTP/1.x，统一改写状态行协议
+	response.Proto = "HTTP/1.1"
+	response.ProtoMajor = 1
+	response.ProtoMinor = 1
+	return response, nil
+}
+
+func (s *Server) closeUpstream() {
+	if upstream := s.upstream.Load(); upstream != nil {
+		upstream.closeIdleConnections()
+	}
+}
+
+func (u *upstreamTransport) closeIdleConnections() {
+	u.transport.CloseIdleConnections()
+	u.h2c.CloseIdleConnections()
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bufio"
 	"io"
 	"net"
 )
@@ -10,3 +11,13 @@ func CopyData(dst, src net.Conn, errChan chan<- error) {
 	_, err := io.Copy(dst, src)
 	errChan <- err
 }
+
+// BufferedConn 读取时先消费 Reader 中已缓冲的数据，再读取底层连接
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
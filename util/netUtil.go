@@ -106,14 +106,10 @@ func GetClientIP(conn net.Conn) string {
 		return ""
 	}
 	addr := conn.RemoteAddr().String()
-	if addr == "" {
-		return ""
-	}
-	split := strings.Split(addr, ":")
-	if len(split) == 1 {
-		return addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
 	}
-	return split[0]
+	return addr
 }
 
 func GetIPFromDomain(domain string) ([]string, error) {
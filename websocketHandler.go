@@ -0,0 +1,409 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+// WebSocket 帧 opcode
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// maxWebSocketMessage 单条消息（合并分片、解压后）的最大长度
+const maxWebSocketMessage = 64 << 20
+
+// deflateOffer 转发给服务端的 permessage-deflate 协商：双方都不保留压缩上下文，代理才能逐条解压和重新压缩
+const deflateOffer = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// deflateTail 补齐被发送方去掉的同步刷新标记，再追加一个空的最终块让解压器正常结束
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+var (
+	ErrWebSocketNotFound = errors.New("proxy: websocket session not found")
+	errWebSocketFrame    = errors.New("proxy: invalid websocket frame")
+	errWebSocketTooLarge = errors.New("proxy: websocket message too large")
+)
+
+// ConfigOnWebSocketMessage 配置 WebSocket 消息钩子，可以观察、改写或丢弃每条文本/二进制消息；
+// 为 nil 时握手完成后直接转发字节
+func (s *Server) ConfigOnWebSocketMessage(onMessage model.WebSocketCall) {
+	s.config.webSocketCall = onMessage
+}
+
+// SendWebSocket 向指定连接注入一条消息，id 为握手请求 ID，upstream 为 true 时发往服务端
+func (s *Server) SendWebSocket(id string, upstream bool, opcode int, payload []byte) error {
+	value, ok := s.sockets.Load(id)
+	if !ok {
+		return ErrWebSocketNotFound
+	}
+	if opcode != model.WebSocketText && opcode != model.WebSocketBinary {
+		return fmt.Errorf("proxy: unsupported websocket opcode %d", opcode)
+	}
+	return value.(*wsSession).write(upstream, wsFrame{fin: true, opcode: byte(opcode), payload: payload})
+}
+
+// isWebSocketUpgrade 判断请求是否为 WebSocket 握手
+func isWebSocketUpgrade(header http.Header) bool {
+	return headerHasToken(header, "Connection", "upgrade") && headerHasToken(header, "Upgrade", "websocket")
+}
+
+// headerHasToken 逗号分隔的头部中是否包含 token，忽略大小写
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareWebSocketOffer 其它扩展会占用 RSV 位，代理无法解析，只保留 permessage-deflate
+func prepareWebSocketOffer(header http.Header) {
+	if offersDeflate(header) {
+		header.Set("Sec-WebSocket-Extensions", deflateOffer)
+	} else {
+		header.Del("Sec-WebSocket-Extensions")
+	}
+}
+
+// serveWebSocket 握手完成后按消息转发，upstream 为服务端连接
+func (s *Server) serveWebSocket(wrapReq model.WrapRequest, req *http.Request, upstream io.ReadWriteCloser, deflate, serverTakeover bool) {
+	session := &wsSession{
+		id:             wrapReq.ID,
+		host:           req.Host,
+		url:            req.URL.Path,
+		client:         wrapReq.Conn,
+		server:         upstream,
+		onEvent:        s.config.webSocketCall,
+		deflate:        deflate,
+		serverTakeover: serverTakeover,
+	}
+	s.sockets.Store(session.id, session)
+	defer s.sockets.Delete(session.id)
+	session.serve(wrapReq.Reader)
+}
+
+// offersDeflate 客户端的扩展协商中是否包含 permessage-deflate
+func offersDeflate(header http.Header) bool {
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			if extensionName(ext) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptDeflate 解析服务端接受的扩展，并改写返回给客户端的协商结果：
+// 要求客户端不保留压缩上下文，代理发往客户端的消息使用默认窗口。
+// serverTakeover 为 true 表示服务端没有接受 server_no_context_takeover，下行压缩消息只能原样转发
+func acceptDeflate(header http.Header) (deflate bool, serverTakeover bool) {
+	value := header.Get("Sec-WebSocket-Extensions")
+	if extensionName(value) != "permessage-deflate" {
+		header.Del("Sec-WebSocket-Extensions")
+		return false, false
+	}
+	serverTakeover = true
+	for _, param := range strings.Split(value, ";")[1:] {
+		if strings.EqualFold(strings.TrimSpace(param), "server_no_context_takeover") {
+			serverTakeover = false
+		}
+	}
+	accepted := "permessage-deflate; client_no_context_takeover"
+	if !serverTakeover {
+		accepted = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+	}
+	header.Set("Sec-WebSocket-Extensions", accepted)
+	return true, serverTakeover
+}
+
+func extensionName(ext string) string {
+	name, _, _ := strings.Cut(ext, ";")
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// wsFrame 单个 WebSocket 帧，payload 已去掉掩码
+type wsFrame struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	payload []byte
+}
+
+// readWSFrame 读取一个帧
+func readWSFrame(r io.Reader) (wsFrame, error) {
+	var frame wsFrame
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return frame, err
+	}
+	frame.fin = head[0]&0x80 != 0
+	frame.rsv1 = head[0]&0x40 != 0
+	frame.opcode = head[0] & 0x0f
+	if head[0]&0x30 != 0 {
+		return frame, errWebSocketFrame
+	}
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return frame, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return frame, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketMessage {
+		return frame, errWebSocketTooLarge
+	}
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return frame, err
+		}
+	}
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.payload); err != nil {
+		return frame, err
+	}
+	if masked {
+		maskBytes(key, frame.payload)
+	}
+	return frame, nil
+}
+
+// writeWSFrame 写入一个帧，客户端发往服务端的帧必须加掩码
+func writeWSFrame(w io.Writer, frame wsFrame, mask bool) error {
+	buf := make([]byte, 0, 14+len(frame.payload))
+	b0 := frame.opcode
+	if frame.fin {
+		b0 |= 0x80
+	}
+	if frame.rsv1 {
+		b0 |= 0x40
+	}
+	buf = append(buf, b0)
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	length := len(frame.payload)
+	switch {
+	case length < 126:
+		buf = append(buf, maskBit|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+	if !mask {
+		buf = append(buf, frame.payload...)
+		_, err := w.Write(buf)
+		return err
+	}
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	buf = append(buf, key[:]...)
+	start := len(buf)
+	buf = append(buf, frame.payload...)
+	maskBytes(key, buf[start:])
+	_, err := w.Write(buf)
+	return err
+}
+
+func maskBytes(key [4]byte, payload []byte) {
+	for i := range payload {
+		payload[i] ^= key[i&3]
+	}
+}
+
+// inflateMessage 解压 permessage-deflate 消息
+func inflateMessage(payload []byte) ([]byte, error) {
+	reader := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail)))
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxWebSocketMessage+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxWebSocketMessage {
+		return nil, errWebSocketTooLarge
+	}
+	return data, nil
+}
+
+// deflateMessage 不保留上下文压缩一条消息，并去掉末尾的同步刷新标记
+func deflateMessage(payload []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err = writer.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail[:4]), nil
+}
+
+// wsSession 一个被拦截的 WebSocket 连接
+type wsSession struct {
+	id      string
+	host    string
+	url     string
+	client  net.Conn
+	server  io.ReadWriteCloser
+	onEvent model.WebSocketCall
+	// deflate 协商了 permessage-deflate
+	deflate bool
+	// serverTakeover 服务端保留压缩上下文，下行压缩消息无法单独解压
+	serverTakeover bool
+
+	clientLock sync.Mutex // 串行写客户端
+	serverLock sync.Mutex // 串行写服务端
+}
+
+// serve 两个方向各自读取消息，任一方向结束后关闭两端
+func (ws *wsSession) serve(clientReader io.Reader) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := ws.pump(ws.server, false); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			log.Println("WebSocket downstream:", err)
+		}
+		_ = ws.client.Close()
+	}()
+	if err := ws.pump(clientReader, true); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		log.Println("WebSocket upstream:", err)
+	}
+	_ = ws.server.Close()
+	_ = ws.client.Close()
+	<-done
+}
+
+// pump 读取一个方向的帧：控制帧立即转发，数据帧合并成完整消息后交给钩子
+func (ws *wsSession) pump(src io.Reader, upstream bool) error {
+	var message []byte
+	var opcode byte
+	var compressed bool
+	for {
+		frame, err := readWSFrame(src)
+		if err != nil {
+			return err
+		}
+		switch frame.opcode {
+		case wsOpClose, wsOpPing, wsOpPong:
+			if !frame.fin || len(frame.payload) > 125 {
+				return errWebSocketFrame
+			}
+			if err = ws.write(upstream, frame); err != nil {
+				return err
+			}
+			continue
+		case wsOpContinuation:
+			if opcode == 0 {
+				return errWebSocketFrame
+			}
+			if len(message)+len(frame.payload) > maxWebSocketMessage {
+				return errWebSocketTooLarge
+			}
+			message = append(message, frame.payload...)
+		case wsOpText, wsOpBinary:
+			if opcode != 0 {
+				return errWebSocketFrame
+			}
+			opcode, compressed, message = frame.opcode, frame.rsv1, frame.payload
+		default:
+			return errWebSocketFrame
+		}
+		if !frame.fin {
+			continue
+		}
+		if err = ws.deliver(upstream, opcode, compressed, message); err != nil {
+			return err
+		}
+		message, opcode, compressed = nil, 0, false
+	}
+}
+
+// deliver 解压消息并调用钩子，按钩子结果转发、改写或丢弃
+func (ws *wsSession) deliver(upstream bool, opcode byte, compressed bool, payload []byte) error {
+	if compressed && (!ws.deflate || (!upstream && ws.serverTakeover)) {
+		// 无法单独解压，保持原样转发
+		return ws.write(upstream, wsFrame{fin: true, rsv1: true, opcode: opcode, payload: payload})
+	}
+	if compressed {
+		var err error
+		if payload, err = inflateMessage(payload); err != nil {
+			return err
+		}
+	}
+	result := ws.onEvent(model.WebSocketMessage{
+		ID:       ws.id,
+		Host:     ws.host,
+		Url:      ws.url,
+		Upstream: upstream,
+		Opcode:   int(opcode),
+		Payload:  payload,
+	})
+	if result.Drop {
+		return nil
+	}
+	result.Payload = hookValue(result.Payload, payload, result.Modified)
+	if result.Opcode == model.WebSocketText || result.Opcode == model.WebSocketBinary {
+		opcode = byte(result.Opcode)
+	}
+	frame := wsFrame{fin: true, opcode: opcode, payload: result.Payload}
+	if compressed {
+		deflated, err := deflateMessage(result.Payload)
+		if err != nil {
+			return err
+		}
+		frame.rsv1, frame.payload = true, deflated
+	}
+	return ws.write(upstream, frame)
+}
+
+// write 向服务端（upstream 为 true）或客户端写入一帧
+func (ws *wsSession) write(upstream bool, frame wsFrame) error {
+	if upstream {
+		ws.serverLock.Lock()
+		defer ws.serverLock.Unlock()
+		return writeWSFrame(ws.server, frame, true)
+	}
+	ws.clientLock.Lock()
+	defer ws.clientLock.Unlock()
+	return writeWSFrame(ws.client, frame, false)
+}
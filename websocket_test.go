@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xyjwsj/request-proxy/model"
+)
+
+// startWebSocketEcho 回显每条消息的 WebSocket 服务端，客户端提供 permessage-deflate 时接受并原样回显压缩帧
+func startWebSocketEcho(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r.Header) {
+			http.Error(w, "not websocket", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		_, _ = rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n")
+		if offersDeflate(r.Header) {
+			_, _ = rw.WriteString("Sec-WebSocket-Extensions: " + r.Header.Get("Sec-WebSocket-Extensions") + "\r\n")
+		}
+		_, _ = rw.WriteString("\r\n")
+		_ = rw.Flush()
+		for {
+			frame, err := readWSFrame(rw)
+			if err != nil {
+				return
+			}
+			if frame.opcode == wsOpClose {
+				_ = writeWSFrame(conn, frame, false)
+				return
+			}
+			if err = writeWSFrame(conn, frame, false); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+// dialWebSocket 经代理发起 WebSocket 握手
+func dialWebSocket(t *testing.T, proxyAddr, target string, deflate bool) (net.Conn, *bufio.Reader, http.Header) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := "GET " + target + "/chat HTTP/1.1\r\nHost: " + strings.TrimPrefix(target, "http://") +
+		"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	if deflate {
+		request += "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n"
+	}
+	if _, err = conn.Write([]byte(request + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+	return conn, reader, response.Header
+}
+
+func TestWebSocketIntercept(t *testing.T) {
+	origin := startWebSocketEcho(t)
+	defer origin.Close()
+
+	server := NewServer("")
+	var sessionID string
+	var lock sync.Mutex
+	server.ConfigOnWebSocketMessage(func(data model.WebSocketMessage) model.WebSocketMessage {
+		lock.Lock()
+		sessionID = data.ID
+		lock.Unlock()
+		if string(data.Payload) == "drop" {
+			data.Drop = true
+		} else if data.Upstream {
+			data.Payload = []byte(strings.ToUpper(string(data.Payload)))
+		} else {
+			data.Payload = append(data.Payload, '!')
+		}
+		return data
+	})
+	proxyAddr, _, shutdown := startProxy(t, server)
+	defer shutdown()
+
+	for _, deflate := range []bool{false, true} {
+		conn, reader, header := dialWebSocket(t, proxyAddr, origin.URL, deflate)
+		if deflate && header.Get("Sec-WebSocket-Extensions") != deflateOffer {
+			t.Fatalf("unexpected extensions %q", header.Get("Sec-WebSocket-Extensions"))
+		}
+		send := func(text string) {
+			frame := wsFrame{fin: true, opcode: wsOpText, payload: []byte(text)}
+			if deflate {
+				frame.payload, _ = deflateMessage(frame.payload)
+				frame.rsv1 = true
+			}
+			if err := writeWSFrame(conn, frame, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		receive := func(compressed bool) string {
+			frame, err := readWSFrame(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.rsv1 != compressed {
+				t.Fatalf("deflate %v: unexpected rsv1 %v", deflate, frame.rsv1)
+			}
+			if frame.rsv1 {
+				frame.payload, err = inflateMessage(frame.payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			return string(frame.payload)
+		}
+
+		// 分片消息由代理合并后交给钩子，未压缩的消息转发后仍不压缩
+		_ = writeWSFrame(conn, wsFrame{opcode: wsOpText, payload: []byte("hel")}, true)
+		_ = writeWSFrame(conn, wsFrame{fin: true, opcode: wsOpContinuation, payload: []byte("lo")}, true)
+		if got := receive(false); got != "HELLO!" {
+			t.Fatalf("deflate %v: unexpected message %q", deflate, got)
+		}
+		send("drop")
+		send("world")
+		if got := receive(deflate); got != "WORLD!" {
+			t.Fatalf("deflate %v: unexpected message %q", deflate, got)
+		}
+
+		lock.Lock()
+		id := sessionID
+		lock.Unlock()
+		if err := server.SendWebSocket(id, false, model.WebSocketText, []byte("injected")); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := readWSFrame(reader)
+		if err != nil || string(frame.payload) != "injected" {
+			t.Fatalf("unexpected injected frame %q, %v", frame.payload, err)
+		}
+
+		_ = writeWSFrame(conn, wsFrame{fin: true, opcode: wsOpClose, payload: []byte{0x03, 0xe8}}, true)
+		if frame, err = readWSFrame(reader); err != nil || frame.opcode != wsOpClose {
+			t.Fatalf("expected close frame, got %v, %v", frame.opcode, err)
+		}
+		_ = conn.Close()
+	}
+	if err := server.SendWebSocket("missing", true, model.WebSocketText, nil); err != ErrWebSocketNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+}